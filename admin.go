@@ -0,0 +1,295 @@
+package goserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	adminBroadcastMaxSize = 1 << 20         // 广播请求体最大长度
+	adminBroadcastTimeout = 5 * time.Second // 广播时单个会话的发送超时时间
+	adminBroadcastWorkers = 64              // 广播并发发送的协程数量
+)
+
+// adminRoute 管理接口路由信息
+type adminRoute struct {
+	Source      string `json:"source"`
+	Path        string `json:"path"`
+	Method      string `json:"method,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// adminSession 管理接口会话信息
+type adminSession struct {
+	ID             string            `json:"id"`
+	Network        Network           `json:"network"`
+	RemoteAddr     string            `json:"remote_addr"`
+	LocalAddr      string            `json:"local_addr"`
+	ConnectedAt    time.Time         `json:"connected_at"`
+	AgeSeconds     float64           `json:"age_seconds"`
+	LastReadAt     *time.Time        `json:"last_read_at,omitempty"`
+	LastWriteAt    *time.Time        `json:"last_write_at,omitempty"`
+	Attrs          map[string]string `json:"attrs"`
+	BytesReceived  int64             `json:"bytes_received"`
+	BytesSent      int64             `json:"bytes_sent"`
+	FramesReceived int64             `json:"frames_received"`
+	FramesSent     int64             `json:"frames_sent"`
+	Errors         int64             `json:"errors"`
+	QueueDepth     int               `json:"queue_depth"`
+	Action         string            `json:"action,omitempty"`
+	Identity       string            `json:"identity,omitempty"`
+}
+
+// AdminHandler 返回管理接口，需自行挂载到http服务并做好访问控制
+//
+//	GET  /routes                        路由表
+//	GET  /sessions[?id=]                在线会话
+//	POST /sessions/close?id=[&reason=]  关闭会话
+//	POST /broadcast                     向所有会话发送请求体
+//	GET  /bans                          封禁名单
+//	POST /ban?ip=[&duration=]           封禁IP，duration为空时永久封禁
+//	POST /unban?ip=                     解除封禁
+func (server *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", server.adminRoutes)
+	mux.HandleFunc("/sessions", server.adminSessions)
+	mux.HandleFunc("/sessions/close", server.adminCloseSession)
+	mux.HandleFunc("/broadcast", server.adminBroadcast)
+	mux.HandleFunc("/bans", server.adminBans)
+	mux.HandleFunc("/ban", server.adminBan)
+	mux.HandleFunc("/unban", server.adminUnban)
+	return mux
+}
+
+// adminRoutes 路由表
+func (server *Server) adminRoutes(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodGet) {
+		return
+	}
+	routes := make([]adminRoute, 0, len(server.actions))
+	for source, actions := range server.routers {
+		for _, action := range actions {
+			routes = append(routes, adminRoute{
+				Source:      source,
+				Path:        action[0],
+				Method:      action[1],
+				Description: action[2],
+			})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Path < routes[j].Path
+	})
+	adminWriteJSON(w, http.StatusOK, routes)
+}
+
+// adminSessions 在线会话
+func (server *Server) adminSessions(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if id := r.URL.Query().Get("id"); id != "" {
+		session, err := server.GetSessionByID(id)
+		if err != nil {
+			adminWriteError(w, http.StatusNotFound, err)
+			return
+		}
+		adminWriteJSON(w, http.StatusOK, newAdminSession(session))
+		return
+	}
+	sessions := make([]adminSession, 0, server.CountSessions())
+	for session := range server.GetAllSessions() {
+		sessions = append(sessions, newAdminSession(session))
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	adminWriteJSON(w, http.StatusOK, sessions)
+}
+
+// adminCloseSession 关闭会话
+func (server *Server) adminCloseSession(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodPost) {
+		return
+	}
+	session, err := server.GetSessionByID(r.URL.Query().Get("id"))
+	if err != nil {
+		adminWriteError(w, http.StatusNotFound, err)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "closed by admin"
+	}
+	session.Close(reason)
+	adminWriteJSON(w, http.StatusOK, map[string]string{"id": session.ID})
+}
+
+// adminBroadcast 向所有会话发送请求体
+// 并发发送且每个会话有发送超时，不读取数据的客户端不会阻塞其他会话
+func (server *Server) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodPost) {
+		return
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, adminBroadcastMaxSize))
+	if err != nil {
+		adminWriteError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	var sent, failed atomic.Int64
+	sessions := server.GetAllSessions()
+	var wg sync.WaitGroup
+	for i := 0; i < adminBroadcastWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for session := range sessions {
+				if err := server.adminSend(session, message); err != nil {
+					failed.Add(1)
+					continue
+				}
+				sent.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	adminWriteJSON(w, http.StatusOK, map[string]int64{"sent": sent.Load(), "failed": failed.Load()})
+}
+
+// adminSend 在超时时间内发送数据，超时的会话被关闭
+// 不修改连接的发送超时，避免影响其他协程同时进行的发送
+func (server *Server) adminSend(session *AppSession, message []byte) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- session.Send(message)
+	}()
+	timer := time.NewTimer(adminBroadcastTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		// 关闭会话以结束阻塞的发送
+		err := errors.Wrap(os.ErrDeadlineExceeded, "broadcast timeout")
+		server.closeSession(session, newCloseReason(CloseWriteFailed, err))
+		return err
+	}
+}
+
+// adminBans 封禁名单
+func (server *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodGet) {
+		return
+	}
+	bans := make(map[string]*time.Time)
+	for ip, expire := range server.BannedIPs() {
+		if expire.IsZero() {
+			bans[ip] = nil
+			continue
+		}
+		expire := expire
+		bans[ip] = &expire
+	}
+	adminWriteJSON(w, http.StatusOK, bans)
+}
+
+// adminBan 封禁IP
+func (server *Server) adminBan(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var duration time.Duration
+	if value := r.URL.Query().Get("duration"); value != "" {
+		var err error
+		if duration, err = time.ParseDuration(value); err != nil {
+			adminWriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	ip := r.URL.Query().Get("ip")
+	if err := server.Ban(ip, duration); err != nil {
+		adminWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	adminWriteJSON(w, http.StatusOK, map[string]string{"ip": ip})
+}
+
+// adminUnban 解除封禁
+func (server *Server) adminUnban(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowMethod(w, r, http.MethodPost) {
+		return
+	}
+	ip := r.URL.Query().Get("ip")
+	if err := server.Unban(ip); err != nil {
+		adminWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	adminWriteJSON(w, http.StatusOK, map[string]string{"ip": ip})
+}
+
+// newAdminSession 生成会话信息
+func newAdminSession(session *AppSession) adminSession {
+	attrs := make(map[string]string)
+	for k, v := range session.Attrs() {
+		attrs[k] = fmt.Sprint(v)
+	}
+	stats := session.Stats()
+	info := adminSession{
+		ID:             stats.ID,
+		Network:        stats.Network,
+		RemoteAddr:     stats.RemoteAddr.String(),
+		LocalAddr:      stats.LocalAddr.String(),
+		ConnectedAt:    stats.ConnectedAt,
+		AgeSeconds:     time.Since(stats.ConnectedAt).Seconds(),
+		Attrs:          attrs,
+		BytesReceived:  stats.BytesReceived,
+		BytesSent:      stats.BytesSent,
+		FramesReceived: stats.FramesReceived,
+		FramesSent:     stats.FramesSent,
+		Errors:         stats.Errors,
+		QueueDepth:     session.QueueDepth(),
+		Action:         stats.CurrentAction,
+	}
+	if !stats.LastReadAt.IsZero() {
+		info.LastReadAt = &stats.LastReadAt
+	}
+	if !stats.LastWriteAt.IsZero() {
+		info.LastWriteAt = &stats.LastWriteAt
+	}
+	if identity := session.Identity(); identity != nil {
+		info.Identity = identity.Name
+	}
+	return info
+}
+
+// adminAllowMethod 检查请求方法
+func adminAllowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	adminWriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// adminWriteJSON 输出json
+func adminWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// adminWriteError 输出错误
+func adminWriteError(w http.ResponseWriter, status int, err error) {
+	adminWriteJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,220 @@
+package arq
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPair 创建一对通过有损内存链路相连的连接
+func lossyPair(lossRate float64, cfg *Config) (*Conn, *Conn) {
+	var (
+		a, b *Conn
+		mu   sync.Mutex
+		rnd  = rand.New(rand.NewSource(1))
+	)
+	drop := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rnd.Float64() < lossRate
+	}
+	deliver := func(to **Conn) func([]byte) error {
+		return func(data []byte) error {
+			if drop() {
+				return nil
+			}
+			packet := append([]byte(nil), data...)
+			go func() {
+				_ = (*to).Input(packet)
+			}()
+			return nil
+		}
+	}
+	a = NewConn(7, cfg, nil, nil, deliver(&b))
+	b = NewConn(7, cfg, nil, nil, deliver(&a))
+	return a, b
+}
+
+func TestReliableTransfer(t *testing.T) {
+	a, b := lossyPair(0.2, &Config{MTU: 200, NoDelay: true, FastResend: 2, MinRTO: 20 * time.Millisecond, DeadLink: 100})
+	defer a.Close()
+	defer b.Close()
+
+	payload := make([]byte, 64*1024)
+	rand.New(rand.NewSource(2)).Read(payload)
+
+	go func() {
+		for data := payload; len(data) > 0; {
+			size := 1000
+			if size > len(data) {
+				size = len(data)
+			}
+			if _, err := a.Write(data[:size]); err != nil {
+				t.Error(err)
+				return
+			}
+			data = data[size:]
+		}
+	}()
+
+	_ = b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(b, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, received) {
+		t.Fatal("received data mismatch")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, b := lossyPair(0, nil)
+	defer a.Close()
+	defer b.Close()
+
+	_ = b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := b.Read(make([]byte, 10))
+	if err != ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestConvMismatch(t *testing.T) {
+	a := NewConn(1, nil, nil, nil, func([]byte) error { return nil })
+	defer a.Close()
+
+	seg := &segment{conv: 2, cmd: cmdPush, data: []byte("x")}
+	if err := a.Input(seg.encode(nil)); err != ErrConvMismatch {
+		t.Fatalf("expected conv mismatch, got %v", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	var (
+		server *Conn
+		client *Conn
+		mu     sync.Mutex
+	)
+	handshaker := NewHandshaker()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	toClient := func(data []byte) error {
+		packet := append([]byte(nil), data...)
+		go func() { _ = client.Input(packet) }()
+		return nil
+	}
+	client = newConn(3, nil, nil, nil, func(data []byte) error {
+		packet := append([]byte(nil), data...)
+		mu.Lock()
+		defer mu.Unlock()
+		if server == nil {
+			conv, reply, ok := handshaker.Accept(addr, packet)
+			if reply != nil {
+				_ = toClient(reply)
+			}
+			if !ok {
+				return nil
+			}
+			server = NewConn(conv, nil, nil, addr, toClient)
+		}
+		go func(server *Conn) { _ = server.Input(packet) }(server)
+		return nil
+	}, false)
+	defer client.Close()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		s := server
+		mu.Unlock()
+		if s != nil {
+			defer s.Close()
+			_ = s.SetReadDeadline(deadline)
+			buf := make([]byte, 10)
+			n, err := s.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "hello" {
+				t.Fatalf("unexpected data %q", buf[:n])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handshake not completed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandshakeRejectsInvalidCookie(t *testing.T) {
+	handshaker := NewHandshaker()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	if _, reply, ok := handshaker.Accept(addr, (&segment{conv: 1, cmd: cmdPush, data: []byte("x")}).encode(nil)); ok || reply != nil {
+		t.Fatal("non handshake segment should be dropped")
+	}
+
+	syn := (&segment{conv: 1, cmd: cmdSyn, data: make([]byte, cookieSize)}).encode(nil)
+	_, reply, ok := handshaker.Accept(addr, syn)
+	if ok || reply == nil {
+		t.Fatal("expected cookie reply")
+	}
+	if len(reply) > len(syn) {
+		t.Fatal("cookie reply larger than request")
+	}
+	cookie, _, err := decodeSegment(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := (&segment{conv: 1, cmd: cmdSyn, data: cookie.data}).encode(nil)
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9000}
+	if _, _, ok := handshaker.Accept(other, echo); ok {
+		t.Fatal("cookie accepted from another address")
+	}
+	if conv, _, ok := handshaker.Accept(addr, echo); !ok || conv != 1 {
+		t.Fatal("valid cookie rejected")
+	}
+}
+
+func TestWriteBounded(t *testing.T) {
+	c := NewConn(1, &Config{SendWindow: 4, MTU: 100}, nil, nil, func([]byte) error { return nil })
+	defer c.Close()
+
+	_ = c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := c.Write(make([]byte, 10000))
+	if err != ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if limit := 2 * 4 * (100 - headerSize); n != limit {
+		t.Fatalf("expected %d bytes queued, got %d", limit, n)
+	}
+}
+
+func TestCloseLinger(t *testing.T) {
+	a, b := lossyPair(0.3, &Config{MTU: 200, NoDelay: true, FastResend: 2, MinRTO: 20 * time.Millisecond, DeadLink: 100, Linger: 10 * time.Second})
+	defer b.Close()
+
+	payload := make([]byte, 8*1024)
+	rand.New(rand.NewSource(3)).Read(payload)
+	if _, err := a.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	_ = a.Close()
+
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(b, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, received) {
+		t.Fatal("received data mismatch")
+	}
+}
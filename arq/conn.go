@@ -0,0 +1,778 @@
+// Package arq 实现类似KCP的可靠UDP传输
+// 通过序号、确认、选择性重传、滑动窗口及拥塞控制，在UDP之上提供有序可靠的字节流
+package arq
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed   = errors.New("arq: connection closed")
+	ErrDeadLink = errors.New("arq: dead link, too many retransmissions")
+	ErrTimeout  = timeoutError{}
+)
+
+// timeoutError 超时错误，实现net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "arq: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Config 可靠传输参数
+type Config struct {
+	MTU          int           // 最大传输单元，默认1400
+	SendWindow   int           // 发送窗口(分片数)，默认128
+	RecvWindow   int           // 接收窗口(分片数)，默认128
+	Interval     time.Duration // 内部刷新间隔，默认10ms
+	MinRTO       time.Duration // 最小重传超时，默认100ms
+	NoDelay      bool          // 快速模式，超时重传时rto按1.5倍而不是2倍退避
+	FastResend   int           // 快速重传阈值，分片被跳过确认达到该次数后立即重传，0为关闭
+	NoCongestion bool          // 关闭拥塞控制，仅受收发窗口限制
+	DeadLink     int           // 单个分片最大发送次数，超过后连接失效，默认20
+	Linger       time.Duration // 关闭时等待未确认数据被确认的最长时间，默认1s，<0不等待
+}
+
+// withDefaults 返回填充默认值后的配置
+func (cfg *Config) withDefaults() Config {
+	c := Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.MTU <= headerSize {
+		c.MTU = 1400
+	}
+	if c.SendWindow <= 0 {
+		c.SendWindow = 128
+	}
+	if c.RecvWindow <= 0 {
+		c.RecvWindow = 128
+	}
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Millisecond
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = 100 * time.Millisecond
+	}
+	if c.DeadLink <= 0 {
+		c.DeadLink = 20
+	}
+	if c.Linger == 0 {
+		c.Linger = time.Second
+	}
+	return c
+}
+
+const (
+	maxRTO    = 60000 // 最大重传超时(ms)
+	probeWait = 1000  // 对端窗口为0时的探测间隔(ms)
+)
+
+// Conn 可靠传输连接，实现net.Conn
+type Conn struct {
+	conv   uint32
+	cfg    Config
+	mss    int
+	output func([]byte) error
+	local  net.Addr
+	remote net.Addr
+	start  time.Time
+
+	mu       sync.Mutex
+	sndUna   uint32     // 最早未确认序号
+	sndNxt   uint32     // 下一个发送序号
+	rcvNxt   uint32     // 下一个期望接收序号
+	sndQueue []*segment // 等待进入发送窗口的分片
+	sndBuf   []*segment // 已发送未确认的分片
+	rcvBuf   []*segment // 乱序到达的分片，按序号排序
+	rcvData  bytes.Buffer
+	ackList  []*segment // 待发送的确认
+	rmtWnd   uint32     // 对端接收窗口
+	cwnd     uint32     // 拥塞窗口
+	ssthresh uint32     // 慢启动阈值
+	incr     uint32     // 拥塞避免阶段累计增量
+	srtt     int32
+	rttVar   int32
+	rto      uint32
+	probeTs  uint32
+	tellWnd  bool // 需要告知对端窗口
+
+	established bool   // 握手是否完成，服务端连接创建时即完成
+	cookie      []byte // 服务端下发的握手cookie
+	synTs       uint32 // 下次发送握手请求的时间
+	synXmit     int    // 握手请求发送次数
+	tellEstab   bool   // 需要告知对端握手完成
+	closing     bool   // 正在关闭，不再接受写入
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	err           error // 连接失效原因
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	die        chan struct{}
+	closeOnce  sync.Once
+	onClose    func() error
+}
+
+// NewConn 新建服务端可靠传输连接，应在Handshaker握手成功后创建
+// output 用于将编码后的数据报发送到对端，local和remote仅用于LocalAddr和RemoteAddr
+func NewConn(conv uint32, cfg *Config, local, remote net.Addr, output func([]byte) error) *Conn {
+	return newConn(conv, cfg, local, remote, output, true)
+}
+
+// newConn 新建可靠传输连接，established为false时先与服务端握手
+func newConn(conv uint32, cfg *Config, local, remote net.Addr, output func([]byte) error, established bool) *Conn {
+	c := &Conn{
+		conv:       conv,
+		cfg:        cfg.withDefaults(),
+		output:     output,
+		local:      local,
+		remote:     remote,
+		start:      time.Now(),
+		cwnd:       1,
+		ssthresh:   2,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		die:        make(chan struct{}),
+
+		established: established,
+	}
+	c.mss = c.cfg.MTU - headerSize
+	c.rmtWnd = uint32(c.cfg.RecvWindow)
+	c.rto = uint32(c.cfg.MinRTO / time.Millisecond)
+	if c.rto < 200 {
+		c.rto = 200
+	}
+
+	go c.updateLoop()
+	return c
+}
+
+// Client 基于已连接的UDP socket新建客户端可靠连接
+// 写入的数据在与服务端握手完成后发送，关闭返回的连接时会同时关闭conn
+func Client(conn net.Conn, cfg *Config) *Conn {
+	c := newConn(rand.Uint32(), cfg, conn.LocalAddr(), conn.RemoteAddr(), func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}, false)
+	c.onClose = conn.Close
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			_ = c.Input(buf[:n])
+		}
+	}()
+	return c
+}
+
+// Conv 返回会话编号
+func (c *Conn) Conv() uint32 {
+	return c.conv
+}
+
+// current 返回连接建立以来的毫秒数
+func (c *Conn) current() uint32 {
+	return uint32(time.Since(c.start) / time.Millisecond)
+}
+
+// notify 非阻塞通知
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// fail 标记连接失效
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	notify(c.readEvent)
+	notify(c.writeEvent)
+}
+
+// waitEvent 等待事件，超时或连接关闭时返回错误
+func (c *Conn) waitEvent(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-event:
+		return nil
+	case <-c.die:
+		return ErrClosed
+	case <-timeout:
+		return ErrTimeout
+	}
+}
+
+// Read 读取有序数据
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.rcvData.Len() > 0 {
+			n, _ := c.rcvData.Read(p)
+			c.mu.Unlock()
+			return n, nil
+		}
+		err := c.err
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err := c.waitEvent(c.readEvent, deadline); err != nil {
+			if err == ErrClosed {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+	}
+}
+
+// Write 写入数据，发送队列已满时阻塞直到有空间或超时
+// 发送队列最多缓存两倍发送窗口的分片，超时返回时n为已写入的长度
+func (c *Conn) Write(p []byte) (n int, err error) {
+	for {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return n, err
+		}
+		if c.closing {
+			c.mu.Unlock()
+			return n, ErrClosed
+		}
+		for n < len(p) && len(c.sndQueue)+len(c.sndBuf) < 2*c.cfg.SendWindow {
+			size := len(p) - n
+			if size > c.mss {
+				size = c.mss
+			}
+			c.sndQueue = append(c.sndQueue, &segment{
+				data: append([]byte(nil), p[n:n+size]...),
+			})
+			n += size
+		}
+		if n == len(p) {
+			c.mu.Unlock()
+			return n, nil
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if err := c.waitEvent(c.writeEvent, deadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close 关闭连接，关闭前在Linger时间内等待已写入的数据被对端确认
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.linger()
+		close(c.die)
+		c.fail(ErrClosed)
+		if c.onClose != nil {
+			err = c.onClose()
+		}
+	})
+	return err
+}
+
+// linger 停止写入并等待发送队列中的数据被确认，连接失效或超时后返回
+func (c *Conn) linger() {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	notify(c.writeEvent)
+
+	c.flush()
+	if c.cfg.Linger < 0 {
+		return
+	}
+	timeout := time.NewTimer(c.cfg.Linger)
+	defer timeout.Stop()
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		done := c.err != nil || len(c.sndQueue)+len(c.sndBuf) == 0
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-timeout.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// LocalAddr 本地地址
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr 对端地址
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// SetRemoteAddr 更新对端地址
+func (c *Conn) SetRemoteAddr(addr net.Addr) {
+	c.mu.Lock()
+	c.remote = addr
+	c.mu.Unlock()
+}
+
+// SetDeadline 设置读写超时
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.readEvent)
+	notify(c.writeEvent)
+	return nil
+}
+
+// SetReadDeadline 设置读超时
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readEvent)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writeEvent)
+	return nil
+}
+
+// WaitSend 返回尚未被确认的分片数量
+func (c *Conn) WaitSend() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sndQueue) + len(c.sndBuf)
+}
+
+// updateLoop 定时刷新
+func (c *Conn) updateLoop() {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.die:
+			return
+		case <-ticker.C:
+			c.flush()
+		}
+	}
+}
+
+// Input 处理对端发来的数据报
+func (c *Conn) Input(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.current()
+	prevUna := c.sndUna
+	var (
+		maxAck   uint32
+		hasAck   bool
+		received bool
+	)
+	for len(data) > 0 {
+		seg, rest, err := decodeSegment(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if seg.conv != c.conv {
+			return ErrConvMismatch
+		}
+
+		// 握手未完成时保存cookie并立即重新发送握手请求，收到其他分片说明服务端已建立连接
+		if seg.cmd == cmdCookie {
+			if !c.established && len(seg.data) == cookieSize {
+				c.cookie = seg.data
+				c.synTs = now
+			}
+			continue
+		}
+		c.established = true
+
+		c.rmtWnd = uint32(seg.wnd)
+		c.parseUna(seg.una)
+
+		switch seg.cmd {
+		case cmdAck:
+			if timeDiff(now, seg.ts) >= 0 {
+				c.updateRTT(timeDiff(now, seg.ts))
+			}
+			c.parseAck(seg.sn)
+			if !hasAck || timeDiff(seg.sn, maxAck) > 0 {
+				maxAck = seg.sn
+				hasAck = true
+			}
+		case cmdPush:
+			if timeDiff(seg.sn, c.rcvNxt+uint32(c.cfg.RecvWindow)) < 0 {
+				c.ackList = append(c.ackList, &segment{sn: seg.sn, ts: seg.ts})
+				if timeDiff(seg.sn, c.rcvNxt) >= 0 {
+					c.insertRecv(seg)
+					received = true
+				}
+			}
+		case cmdWask:
+			c.tellWnd = true
+		case cmdSyn:
+			c.tellEstab = true
+		case cmdWins, cmdEstab:
+		default:
+			return errors.New("arq: unknown command")
+		}
+	}
+
+	if hasAck {
+		for _, seg := range c.sndBuf {
+			if timeDiff(seg.sn, maxAck) < 0 {
+				seg.fastAck++
+			}
+		}
+	}
+
+	if received {
+		c.moveRecv()
+		notify(c.readEvent)
+	}
+
+	if timeDiff(c.sndUna, prevUna) > 0 {
+		c.growCwnd()
+		notify(c.writeEvent)
+	}
+	return nil
+}
+
+// parseUna 移除对端已确认的分片
+func (c *Conn) parseUna(una uint32) {
+	count := 0
+	for _, seg := range c.sndBuf {
+		if timeDiff(una, seg.sn) > 0 {
+			count++
+		} else {
+			break
+		}
+	}
+	if count > 0 {
+		c.sndBuf = c.sndBuf[count:]
+	}
+	c.shrinkBuf()
+}
+
+// parseAck 移除单个确认的分片
+func (c *Conn) parseAck(sn uint32) {
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			break
+		}
+		if timeDiff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+	c.shrinkBuf()
+}
+
+// shrinkBuf 更新最早未确认序号
+func (c *Conn) shrinkBuf() {
+	if len(c.sndBuf) > 0 {
+		c.sndUna = c.sndBuf[0].sn
+	} else {
+		c.sndUna = c.sndNxt
+	}
+}
+
+// updateRTT 更新往返时间及重传超时
+func (c *Conn) updateRTT(rtt int32) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttVar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar = (3*c.rttVar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+		if c.srtt < 1 {
+			c.srtt = 1
+		}
+	}
+	interval := int32(c.cfg.Interval / time.Millisecond)
+	if 4*c.rttVar > interval {
+		interval = 4 * c.rttVar
+	}
+	rto := uint32(c.srtt + interval)
+	minRTO := uint32(c.cfg.MinRTO / time.Millisecond)
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	c.rto = rto
+}
+
+// insertRecv 将分片按序号插入接收缓冲
+func (c *Conn) insertRecv(seg *segment) {
+	i := len(c.rcvBuf)
+	for i > 0 {
+		prev := c.rcvBuf[i-1]
+		if prev.sn == seg.sn {
+			return
+		}
+		if timeDiff(seg.sn, prev.sn) > 0 {
+			break
+		}
+		i--
+	}
+	c.rcvBuf = append(c.rcvBuf, nil)
+	copy(c.rcvBuf[i+1:], c.rcvBuf[i:])
+	c.rcvBuf[i] = seg
+}
+
+// moveRecv 将连续分片移入可读数据
+func (c *Conn) moveRecv() {
+	count := 0
+	for _, seg := range c.rcvBuf {
+		if seg.sn != c.rcvNxt {
+			break
+		}
+		c.rcvData.Write(seg.data)
+		c.rcvNxt++
+		count++
+	}
+	if count > 0 {
+		c.rcvBuf = c.rcvBuf[count:]
+	}
+}
+
+// growCwnd 收到新确认后扩大拥塞窗口
+func (c *Conn) growCwnd() {
+	if c.cwnd >= c.rmtWnd {
+		return
+	}
+	mss := uint32(c.mss)
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+		c.incr += mss
+	} else {
+		if c.incr < mss {
+			c.incr = mss
+		}
+		c.incr += (mss*mss)/c.incr + mss/16
+		if (c.cwnd+1)*mss <= c.incr {
+			c.cwnd = (c.incr + mss - 1) / mss
+		}
+	}
+	if c.cwnd > c.rmtWnd {
+		c.cwnd = c.rmtWnd
+		c.incr = c.rmtWnd * mss
+	}
+}
+
+// unusedWindow 返回本端剩余接收窗口
+func (c *Conn) unusedWindow() uint16 {
+	used := len(c.rcvBuf) + (c.rcvData.Len()+c.mss-1)/c.mss
+	if used >= c.cfg.RecvWindow {
+		return 0
+	}
+	return uint16(c.cfg.RecvWindow - used)
+}
+
+// flush 发送确认、新数据及需要重传的分片
+func (c *Conn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	now := c.current()
+	wnd := c.unusedWindow()
+
+	// 握手未完成时仅发送握手请求，按重传超时重试
+	if !c.established {
+		if c.synXmit == 0 || timeDiff(now, c.synTs) >= 0 {
+			cookie := c.cookie
+			if cookie == nil {
+				cookie = make([]byte, cookieSize)
+			}
+			_ = c.output((&segment{conv: c.conv, cmd: cmdSyn, wnd: wnd, data: cookie}).encode(nil))
+			c.synTs = now + c.rto
+			c.synXmit++
+			if c.synXmit >= c.cfg.DeadLink {
+				c.err = ErrDeadLink
+				notify(c.readEvent)
+				notify(c.writeEvent)
+			}
+		}
+		return
+	}
+
+	// 多个分片合并到一个数据报发送，发送失败的分片由重传机制处理
+	buf := make([]byte, 0, c.cfg.MTU)
+	write := func(seg *segment) {
+		if len(buf)+headerSize+len(seg.data) > c.cfg.MTU && len(buf) > 0 {
+			_ = c.output(buf)
+			buf = make([]byte, 0, c.cfg.MTU)
+		}
+		buf = seg.encode(buf)
+	}
+
+	// 确认
+	for _, ack := range c.ackList {
+		write(&segment{conv: c.conv, cmd: cmdAck, wnd: wnd, ts: ack.ts, sn: ack.sn, una: c.rcvNxt})
+	}
+	c.ackList = c.ackList[:0]
+
+	// 对端窗口为0时探测
+	if c.rmtWnd == 0 {
+		if c.probeTs == 0 || timeDiff(now, c.probeTs) >= 0 {
+			write(&segment{conv: c.conv, cmd: cmdWask, wnd: wnd, una: c.rcvNxt})
+			c.probeTs = now + probeWait
+		}
+	} else {
+		c.probeTs = 0
+	}
+	if c.tellWnd {
+		write(&segment{conv: c.conv, cmd: cmdWins, wnd: wnd, una: c.rcvNxt})
+		c.tellWnd = false
+	}
+	if c.tellEstab {
+		write(&segment{conv: c.conv, cmd: cmdEstab, wnd: wnd, una: c.rcvNxt})
+		c.tellEstab = false
+	}
+
+	// 新数据进入发送窗口
+	cwnd := uint32(c.cfg.SendWindow)
+	if c.rmtWnd < cwnd {
+		cwnd = c.rmtWnd
+	}
+	if !c.cfg.NoCongestion && c.cwnd < cwnd {
+		cwnd = c.cwnd
+	}
+	for len(c.sndQueue) > 0 && timeDiff(c.sndNxt, c.sndUna+cwnd) < 0 {
+		seg := c.sndQueue[0]
+		c.sndQueue = c.sndQueue[1:]
+		seg.conv = c.conv
+		seg.cmd = cmdPush
+		seg.sn = c.sndNxt
+		seg.rto = c.rto
+		c.sndNxt++
+		c.sndBuf = append(c.sndBuf, seg)
+	}
+
+	// 发送及重传
+	var change, lost bool
+	for _, seg := range c.sndBuf {
+		needSend := false
+		switch {
+		case seg.xmit == 0:
+			needSend = true
+			seg.rto = c.rto
+			seg.resendTs = now + seg.rto
+		case timeDiff(now, seg.resendTs) >= 0:
+			needSend = true
+			lost = true
+			if c.cfg.NoDelay {
+				seg.rto += seg.rto / 2
+			} else {
+				seg.rto += seg.rto
+			}
+			if seg.rto > maxRTO {
+				seg.rto = maxRTO
+			}
+			seg.resendTs = now + seg.rto
+		case c.cfg.FastResend > 0 && seg.fastAck >= uint32(c.cfg.FastResend):
+			needSend = true
+			change = true
+			seg.fastAck = 0
+			seg.resendTs = now + seg.rto
+		}
+		if !needSend {
+			continue
+		}
+		seg.xmit++
+		seg.ts = now
+		seg.wnd = wnd
+		seg.una = c.rcvNxt
+		write(seg)
+		if seg.xmit >= uint32(c.cfg.DeadLink) {
+			c.err = ErrDeadLink
+		}
+	}
+
+	if len(buf) > 0 {
+		_ = c.output(buf)
+	}
+
+	// 拥塞控制
+	if change {
+		inflight := c.sndNxt - c.sndUna
+		c.ssthresh = inflight / 2
+		if c.ssthresh < 2 {
+			c.ssthresh = 2
+		}
+		c.cwnd = c.ssthresh + uint32(c.cfg.FastResend)
+		c.incr = c.cwnd * uint32(c.mss)
+	}
+	if lost {
+		c.ssthresh = c.cwnd / 2
+		if c.ssthresh < 2 {
+			c.ssthresh = 2
+		}
+		c.cwnd = 1
+		c.incr = uint32(c.mss)
+	}
+
+	if c.err != nil {
+		notify(c.readEvent)
+		notify(c.writeEvent)
+	}
+}
@@ -0,0 +1,58 @@
+package arq
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	cookieSize   = 16               // 握手cookie长度
+	cookiePeriod = 30 * time.Second // cookie有效周期，上一周期的cookie仍然有效
+)
+
+// Handshaker 服务端无状态握手
+// 对端需回显服务端下发的cookie证明地址可达后才创建连接，伪造来源或随意发送的数据报不会占用服务端资源
+// 握手请求与回复长度相同，不会被用于放大攻击
+type Handshaker struct {
+	secret []byte
+}
+
+// NewHandshaker 新建握手器，使用随机密钥生成cookie
+func NewHandshaker() *Handshaker {
+	secret := make([]byte, sha256.Size)
+	_, _ = rand.Read(secret)
+	return &Handshaker{secret: secret}
+}
+
+// Accept 处理尚未建立连接的对端发来的数据报
+// 对端回显有效cookie时返回会话编号及true，此时应新建连接并将该数据报交给连接处理
+// 否则返回需要回复对端的数据报，不是握手请求时为nil
+func (h *Handshaker) Accept(addr net.Addr, datagram []byte) (conv uint32, reply []byte, ok bool) {
+	seg, _, err := decodeSegment(datagram)
+	if err != nil || seg.cmd != cmdSyn || len(seg.data) != cookieSize {
+		return 0, nil, false
+	}
+	period := time.Now().Unix() / int64(cookiePeriod/time.Second)
+	for _, p := range []int64{period, period - 1} {
+		if hmac.Equal(seg.data, h.cookie(addr, seg.conv, p)) {
+			return seg.conv, nil, true
+		}
+	}
+	cookie := &segment{conv: seg.conv, cmd: cmdCookie, data: h.cookie(addr, seg.conv, period)}
+	return 0, cookie.encode(nil), false
+}
+
+// cookie 生成与地址、会话编号及周期绑定的cookie
+func (h *Handshaker) cookie(addr net.Addr, conv uint32, period int64) []byte {
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[0:], conv)
+	binary.BigEndian.PutUint64(buf[4:], uint64(period))
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(buf[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:cookieSize]
+}
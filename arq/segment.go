@@ -0,0 +1,94 @@
+package arq
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	cmdPush   uint8 = 81 // 数据
+	cmdAck    uint8 = 82 // 确认
+	cmdWask   uint8 = 83 // 询问对端窗口
+	cmdWins   uint8 = 84 // 告知本端窗口
+	cmdSyn    uint8 = 85 // 握手请求，携带cookie，首次请求的cookie为空白
+	cmdCookie uint8 = 86 // 服务端下发的握手cookie
+	cmdEstab  uint8 = 87 // 握手完成
+
+	headerSize = 24 // 分片头部长度
+)
+
+var (
+	ErrShortSegment = errors.New("arq: segment too short")
+	ErrConvMismatch = errors.New("arq: conversation id mismatch")
+)
+
+// segment 传输分片
+// 头部依次为 conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4)
+type segment struct {
+	conv uint32
+	cmd  uint8
+	frg  uint8
+	wnd  uint16
+	ts   uint32
+	sn   uint32
+	una  uint32
+	data []byte
+
+	resendTs uint32 // 下次重传时间
+	rto      uint32 // 当前重传超时
+	fastAck  uint32 // 被跳过确认的次数
+	xmit     uint32 // 已发送次数
+}
+
+// encode 将分片头部及数据写入buf，返回写入后的buf
+func (seg *segment) encode(buf []byte) []byte {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[0:], seg.conv)
+	header[4] = seg.cmd
+	header[5] = seg.frg
+	binary.LittleEndian.PutUint16(header[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(header[8:], seg.ts)
+	binary.LittleEndian.PutUint32(header[12:], seg.sn)
+	binary.LittleEndian.PutUint32(header[16:], seg.una)
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(seg.data)))
+	buf = append(buf, header[:]...)
+	return append(buf, seg.data...)
+}
+
+// decodeSegment 从data中解析一个分片，返回分片及剩余数据
+func decodeSegment(data []byte) (*segment, []byte, error) {
+	if len(data) < headerSize {
+		return nil, nil, ErrShortSegment
+	}
+	seg := &segment{
+		conv: binary.LittleEndian.Uint32(data[0:]),
+		cmd:  data[4],
+		frg:  data[5],
+		wnd:  binary.LittleEndian.Uint16(data[6:]),
+		ts:   binary.LittleEndian.Uint32(data[8:]),
+		sn:   binary.LittleEndian.Uint32(data[12:]),
+		una:  binary.LittleEndian.Uint32(data[16:]),
+	}
+	length := binary.LittleEndian.Uint32(data[20:])
+	data = data[headerSize:]
+	if uint32(len(data)) < length {
+		return nil, nil, ErrShortSegment
+	}
+	if length > 0 {
+		seg.data = append([]byte(nil), data[:length]...)
+	}
+	return seg, data[length:], nil
+}
+
+// Conv 读取数据报中的会话编号
+func Conv(datagram []byte) (uint32, bool) {
+	if len(datagram) < headerSize {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(datagram), true
+}
+
+// timeDiff 计算序号或时间差，兼容回绕
+func timeDiff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
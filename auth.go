@@ -0,0 +1,172 @@
+package goserver
+
+import (
+	"strings"
+	"time"
+)
+
+// Identity 会话认证身份
+type Identity struct {
+	Name  string                 // 身份名称
+	Roles []string               // 角色
+	Attrs map[string]interface{} // 自定义属性
+}
+
+// HasRole 判断是否拥有角色
+func (identity *Identity) HasRole(role string) bool {
+	for _, r := range identity.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator 认证方法，处理认证阶段收到的数据
+// 认证成功返回身份，返回nil身份及nil错误表示需要继续接收数据，返回错误时关闭会话
+// response不为nil时发送给客户端
+type Authenticator func(session *AppSession, token []byte) (identity *Identity, response []byte, err error)
+
+// AuthConfig 认证配置
+type AuthConfig struct {
+	Authenticator Authenticator // 认证方法
+	Action        string        // 认证action路径，为空时认证阶段除PublicActions外的数据不经路由直接交给Authenticator
+	MaxFrames     int           // 认证阶段最多接收的数据数量，超过后关闭会话，默认1
+	Timeout       time.Duration // 认证超时时间，超时后关闭会话，默认10s，<0则不设置超时
+	PublicActions []string      // 无需认证即可调用的action路径
+}
+
+// authenticator 认证器
+type authenticator struct {
+	config        AuthConfig
+	action        string
+	publicActions map[string]bool
+}
+
+// SetAuth 设置认证阶段
+// 设置后会话需要先通过认证，除PublicActions外的action在认证前不可调用
+func (server *Server) SetAuth(config AuthConfig) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if config.MaxFrames <= 0 {
+		config.MaxFrames = 1
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	auth := &authenticator{
+		config:        config,
+		action:        strings.ToLower(config.Action),
+		publicActions: make(map[string]bool, len(config.PublicActions)),
+	}
+	for _, action := range config.PublicActions {
+		auth.publicActions[strings.ToLower(action)] = true
+	}
+	server.auth = auth
+	return nil
+}
+
+// startAuthTimer 开始认证超时检测
+func (server *Server) startAuthTimer(session *AppSession) {
+	if server.auth == nil || server.auth.config.Timeout < 0 {
+		return
+	}
+	session.authTimer = time.AfterFunc(server.auth.config.Timeout, func() {
+		if session.Identity() == nil && !session.isClosed() {
+			server.closeSession(session, newCloseReason(CloseRejected, ErrAuthTimeout))
+		}
+	})
+}
+
+// authenticate 处理认证阶段的数据
+// 认证action以外的数据需为无需认证的action，返回是否已处理
+func (server *Server) authenticate(session *AppSession, actionName string, token []byte) (bool, error) {
+	auth := server.auth
+	actionName = strings.ToLower(actionName)
+	if auth.publicActions[actionName] {
+		return false, nil
+	}
+	if auth.action != "" && actionName != auth.action {
+		return true, ErrUnauthenticated
+	}
+
+	if int(session.authFrames.Add(1)) > auth.config.MaxFrames {
+		return true, ErrUnauthenticated
+	}
+	identity, response, err := auth.config.Authenticator(session, token)
+	if response != nil {
+		if sendErr := session.Send(response); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+	if identity == nil {
+		// 达到最大数量仍未完成认证
+		if int(session.authFrames.Load()) >= auth.config.MaxFrames {
+			return true, ErrUnauthenticated
+		}
+		return true, nil
+	}
+
+	session.identity.Store(identity)
+	if session.authTimer != nil {
+		session.authTimer.Stop()
+	}
+	session.log().Debug("session authenticated", "identity", identity.Name)
+	server.events.publish(&Event{Type: EventSessionAuthenticated, Session: session, Identity: identity})
+	return true, nil
+}
+
+// isPublicAction 判断数据是否请求无需认证的action，解析失败时视为需要认证
+// 用于未设置认证action时，在数据交给认证方法前放行无需认证的action
+func (server *Server) isPublicAction(token []byte) bool {
+	if len(server.auth.publicActions) == 0 || server.resolveAction == nil {
+		return false
+	}
+	actionName, _, err := server.resolveAction(token)
+	return err == nil && server.auth.publicActions[strings.ToLower(actionName)]
+}
+
+// RequireAuth 返回要求会话已认证的中间件
+func RequireAuth() ActionFunc {
+	return func(session *AppSession, token []byte) ([]byte, error) {
+		if session.Identity() == nil {
+			return nil, ErrUnauthenticated
+		}
+		return token, nil
+	}
+}
+
+// RequireRoles 返回要求会话拥有任一角色的中间件
+func RequireRoles(roles ...string) ActionFunc {
+	return func(session *AppSession, token []byte) ([]byte, error) {
+		identity := session.Identity()
+		if identity == nil {
+			return nil, ErrUnauthenticated
+		}
+		for _, role := range roles {
+			if identity.HasRole(role) {
+				return token, nil
+			}
+		}
+		return nil, ErrForbidden
+	}
+}
+
+// Authorize 返回按路由选项校验认证及角色的中间件，可注册为before中间件统一鉴权
+func Authorize() ActionFunc {
+	return func(session *AppSession, token []byte) ([]byte, error) {
+		options := session.RouteOptions()
+		if options == nil || (!options.RequireAuth && len(options.Roles) == 0) {
+			return token, nil
+		}
+		if len(options.Roles) == 0 {
+			return RequireAuth()(session, token)
+		}
+		return RequireRoles(options.Roles...)(session, token)
+	}
+}
@@ -0,0 +1,222 @@
+package goserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zboyco/go-server/filter"
+)
+
+// AutoBan 自动封禁规则
+type AutoBan struct {
+	MaxViolations int           // 统计窗口内允许的违规次数(协议错误或超过消息限流)，超过后封禁，<=0不自动封禁
+	Window        time.Duration // 统计窗口，默认1分钟
+	Duration      time.Duration // 封禁时长，默认10分钟
+}
+
+// banList 封禁名单
+type banList struct {
+	bans       map[string]time.Time   // 封禁IP及到期时间，零值为永久封禁
+	violations map[string][]time.Time // 统计窗口内的违规时间
+	cleaned    time.Time              // 上次清理过期记录的时间
+	autoBan    AutoBan
+	sync.Mutex
+}
+
+// newBanList 新建封禁名单
+func newBanList() *banList {
+	return &banList{
+		bans:       make(map[string]time.Time),
+		violations: make(map[string][]time.Time),
+		cleaned:    time.Now(),
+	}
+}
+
+// ipKey 统一IP格式
+func ipKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
+
+// ban 封禁IP
+func (b *banList) ban(ip net.IP, duration time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	var expire time.Time
+	if duration > 0 {
+		expire = time.Now().Add(duration)
+	}
+	key := ipKey(ip)
+	b.bans[key] = expire
+	delete(b.violations, key)
+}
+
+// unban 解除封禁
+func (b *banList) unban(ip net.IP) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.bans, ipKey(ip))
+}
+
+// isBanned 判断IP是否被封禁
+func (b *banList) isBanned(ip net.IP) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	key := ipKey(ip)
+	expire, exist := b.bans[key]
+	if !exist {
+		return false
+	}
+	if !expire.IsZero() && time.Now().After(expire) {
+		delete(b.bans, key)
+		return false
+	}
+	return true
+}
+
+// list 返回封禁名单
+func (b *banList) list() map[string]time.Time {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	result := make(map[string]time.Time, len(b.bans))
+	for key, expire := range b.bans {
+		if !expire.IsZero() && now.After(expire) {
+			delete(b.bans, key)
+			continue
+		}
+		result[key] = expire
+	}
+	return result
+}
+
+// violate 记录违规，达到自动封禁规则时封禁并返回true
+func (b *banList) violate(ip net.IP) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	rule := b.autoBan
+	if rule.MaxViolations <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	b.clean(now)
+	key := ipKey(ip)
+	records := b.violations[key][:0]
+	for _, t := range b.violations[key] {
+		if now.Sub(t) < rule.Window {
+			records = append(records, t)
+		}
+	}
+	records = append(records, now)
+	if len(records) <= rule.MaxViolations {
+		b.violations[key] = records
+		return false
+	}
+
+	delete(b.violations, key)
+	b.bans[key] = now.Add(rule.Duration)
+	return true
+}
+
+// clean 每个统计窗口清理一次已过期的违规记录及封禁，只违规一次的IP不会一直保留
+func (b *banList) clean(now time.Time) {
+	if now.Sub(b.cleaned) < b.autoBan.Window {
+		return
+	}
+	for key, records := range b.violations {
+		if now.Sub(records[len(records)-1]) >= b.autoBan.Window {
+			delete(b.violations, key)
+		}
+	}
+	for key, expire := range b.bans {
+		if !expire.IsZero() && now.After(expire) {
+			delete(b.bans, key)
+		}
+	}
+	b.cleaned = now
+}
+
+// SetAutoBan 设置自动封禁规则
+func (server *Server) SetAutoBan(rule AutoBan) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if rule.Window <= 0 {
+		rule.Window = time.Minute
+	}
+	if rule.Duration <= 0 {
+		rule.Duration = 10 * time.Minute
+	}
+	server.banList.Lock()
+	server.banList.autoBan = rule
+	server.banList.Unlock()
+	return nil
+}
+
+// Ban 封禁IP，duration<=0时永久封禁
+// 封禁后拒绝该IP的新连接，并关闭其现有会话
+func (server *Server) Ban(ip string, duration time.Duration) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return &net.ParseError{Type: "IP address", Text: ip}
+	}
+	server.banList.ban(parsed, duration)
+	server.closeSessionsByIP(parsed, &CloseReason{Kind: CloseRejected, Text: "banned"})
+	return nil
+}
+
+// Unban 解除封禁
+func (server *Server) Unban(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return &net.ParseError{Type: "IP address", Text: ip}
+	}
+	server.banList.unban(parsed)
+	return nil
+}
+
+// IsBanned 判断IP是否被封禁
+func (server *Server) IsBanned(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && server.banList.isBanned(parsed)
+}
+
+// BannedIPs 返回封禁名单及到期时间，零值为永久封禁
+func (server *Server) BannedIPs() map[string]time.Time {
+	return server.banList.list()
+}
+
+// isAddrBanned 判断地址是否被封禁
+func (server *Server) isAddrBanned(addr net.Addr) bool {
+	ip := filter.AddrIP(addr)
+	return ip != nil && server.banList.isBanned(ip)
+}
+
+// recordViolation 记录会话违规，达到自动封禁规则时封禁并关闭会话
+func (server *Server) recordViolation(session *AppSession) {
+	ip := filter.AddrIP(session.RemoteAddr())
+	if ip == nil || !server.banList.violate(ip) {
+		return
+	}
+	server.log().Warn("ip banned because too many violations", "ip", ip.String())
+	server.closeSessionsByIP(ip, &CloseReason{Kind: CloseRejected, Text: "banned"})
+}
+
+// closeSessionsByIP 关闭指定IP的所有会话
+func (server *Server) closeSessionsByIP(ip net.IP, reason *CloseReason) {
+	for session := range server.GetAllSessions() {
+		if sessionIP := filter.AddrIP(session.RemoteAddr()); sessionIP != nil && sessionIP.Equal(ip) && !session.isClosed() {
+			server.closeSession(session, reason)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package capture 实现会话流量录制文件的读写
+//
+// 文件以"GSCP"及版本号开头，之后为连续的记录，每条记录格式为：
+//
+//	方向(1字节) 时间(varint，UnixNano) 会话ID长度(uvarint) 会话ID action长度(uvarint) action 数据长度(uvarint) 数据
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidFile   = errors.New("capture: invalid capture file")
+	ErrInvalidRecord = errors.New("capture: invalid capture record")
+)
+
+// magic 文件头
+var magic = []byte("GSCP")
+
+const (
+	version       byte = 1
+	maxFieldLen        = 64 * 1024 * 1024 // 单个字段最大长度，避免损坏的文件导致过大的内存分配
+	maxStringLen       = 64 * 1024        // 会话ID及action最大长度
+	recordMaxHead      = 1 + binary.MaxVarintLen64
+)
+
+// Direction 记录方向
+type Direction byte
+
+const (
+	Open     Direction = iota + 1 // 会话建立，数据为客户端地址
+	Inbound                       // 接收的消息，数据为拆包消耗的原始数据
+	Outbound                      // 发送的数据
+	Close                         // 会话关闭，数据为关闭原因
+)
+
+// String 返回方向描述
+func (d Direction) String() string {
+	switch d {
+	case Open:
+		return "open"
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	case Close:
+		return "close"
+	default:
+		return fmt.Sprintf("direction(%d)", byte(d))
+	}
+}
+
+// Record 录制记录
+type Record struct {
+	Time      time.Time // 时间
+	Direction Direction // 方向
+	SessionID string    // 会话ID
+	Action    string    // action路径
+	Payload   []byte    // 数据
+}
+
+// Writer 录制文件写入器，可并发写入
+type Writer struct {
+	w      *bufio.Writer
+	closer io.Closer
+	sync.Mutex
+}
+
+// NewWriter 新建写入器并写入文件头
+func NewWriter(w io.Writer) (*Writer, error) {
+	writer := &Writer{w: bufio.NewWriter(w)}
+	if closer, ok := w.(io.Closer); ok {
+		writer.closer = closer
+	}
+	if _, err := writer.w.Write(append(append([]byte(nil), magic...), version)); err != nil {
+		return nil, err
+	}
+	if err := writer.w.Flush(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Create 创建录制文件
+func Create(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := NewWriter(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write 写入一条记录，写入后立即刷新
+func (w *Writer) Write(record Record) error {
+	w.Lock()
+	defer w.Unlock()
+
+	var head [recordMaxHead]byte
+	head[0] = byte(record.Direction)
+	n := 1 + binary.PutVarint(head[1:], record.Time.UnixNano())
+	if _, err := w.w.Write(head[:n]); err != nil {
+		return err
+	}
+	for _, field := range [][]byte{[]byte(record.SessionID), []byte(record.Action), record.Payload} {
+		if err := w.writeField(field); err != nil {
+			return err
+		}
+	}
+	return w.w.Flush()
+}
+
+// writeField 写入长度及内容
+func (w *Writer) writeField(field []byte) error {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(field)))
+	if _, err := w.w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(field)
+	return err
+}
+
+// Close 刷新缓冲区，底层写入对象实现io.Closer时将其关闭
+func (w *Writer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	err := w.w.Flush()
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Reader 录制文件读取器
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader 新建读取器并校验文件头
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+	head := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(reader.r, head); err != nil {
+		return nil, ErrInvalidFile
+	}
+	if string(head[:len(magic)]) != string(magic) || head[len(magic)] != version {
+		return nil, ErrInvalidFile
+	}
+	return reader, nil
+}
+
+// Next 读取下一条记录，没有更多记录时返回io.EOF
+func (r *Reader) Next() (Record, error) {
+	direction, err := r.r.ReadByte()
+	if err != nil {
+		return Record{}, err
+	}
+	if direction < byte(Open) || direction > byte(Close) {
+		return Record{}, ErrInvalidRecord
+	}
+	timestamp, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return Record{}, unexpectedEOF(err)
+	}
+	sessionID, err := r.readField(maxStringLen)
+	if err != nil {
+		return Record{}, err
+	}
+	action, err := r.readField(maxStringLen)
+	if err != nil {
+		return Record{}, err
+	}
+	payload, err := r.readField(maxFieldLen)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Time:      time.Unix(0, timestamp),
+		Direction: Direction(direction),
+		SessionID: string(sessionID),
+		Action:    string(action),
+		Payload:   payload,
+	}, nil
+}
+
+// readField 读取长度及内容
+func (r *Reader) readField(max int) ([]byte, error) {
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if length > uint64(max) {
+		return nil, ErrInvalidRecord
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r.r, field); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return field, nil
+}
+
+// ReadAll 读取全部记录
+func ReadAll(r io.Reader) ([]Record, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// unexpectedEOF 记录中途结束时返回io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	records := []Record{
+		{Time: now, Direction: Open, SessionID: "s1", Payload: []byte("127.0.0.1:1234")},
+		{Time: now.Add(time.Millisecond), Direction: Inbound, SessionID: "s1", Action: "/say", Payload: []byte("/say hi\n")},
+		{Time: now.Add(2 * time.Millisecond), Direction: Outbound, SessionID: "s1", Action: "/say", Payload: []byte("hi\n")},
+		{Time: now.Add(3 * time.Millisecond), Direction: Close, SessionID: "s1", Payload: []byte("EOF")},
+	}
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := ReadAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), len(result))
+	}
+	for i := range records {
+		if !result[i].Time.Equal(records[i].Time) || result[i].Direction != records[i].Direction ||
+			result[i].SessionID != records[i].SessionID || result[i].Action != records[i].Action ||
+			!bytes.Equal(result[i].Payload, records[i].Payload) {
+			t.Fatalf("record %d mismatch: %+v != %+v", i, result[i], records[i])
+		}
+	}
+
+	// 记录不完整
+	if _, err := ReadAll(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("nope"))); err != ErrInvalidFile {
+		t.Fatalf("expected invalid file error, got %v", err)
+	}
+}
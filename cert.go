@@ -0,0 +1,212 @@
+package goserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zboyco/go-server/internal/watcher"
+)
+
+// certFile 证书文件
+type certFile struct {
+	certPath string
+	keyPath  string
+	modTime  time.Time // 证书及私钥文件中较新的修改时间
+}
+
+// certSet 一组证书，按SNI查找
+type certSet struct {
+	byName      map[string]*tls.Certificate // 域名对应的证书，支持*.开头的通配符域名
+	defaultCert *tls.Certificate            // 无法按SNI匹配时使用的证书
+}
+
+// CertManager 证书管理器
+// 从文件加载证书，按SNI选择证书，可在运行时重新加载并原子替换
+type CertManager struct {
+	certs atomic.Value // *certSet
+
+	files []*certFile
+	mu    sync.Mutex // 证书文件锁
+}
+
+// NewCertManager 新建证书管理器
+func NewCertManager() *CertManager {
+	m := &CertManager{}
+	m.certs.Store(&certSet{byName: make(map[string]*tls.Certificate)})
+	return m
+}
+
+// AddFile 添加证书及私钥文件并立即加载
+// 证书按其中的域名匹配SNI，第一个添加的证书作为默认证书
+func (m *CertManager) AddFile(certPath, keyPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := append(m.files[:len(m.files):len(m.files)], &certFile{certPath: certPath, keyPath: keyPath})
+	if err := m.load(files); err != nil {
+		return err
+	}
+	m.files = files
+	return nil
+}
+
+// Reload 重新加载全部证书文件
+// 任一文件加载失败时保留原有证书
+func (m *CertManager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.load(m.files)
+}
+
+// load 加载证书文件并替换当前证书
+func (m *CertManager) load(files []*certFile) error {
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		modTime, err := file.stat()
+		if err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(file.certPath, file.keyPath)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("load certificate %s error", file.certPath))
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("parse certificate %s error", file.certPath))
+			}
+		}
+		set.add(&cert)
+		modTimes[i] = modTime
+	}
+
+	m.certs.Store(set)
+	for i, file := range files {
+		file.modTime = modTimes[i]
+	}
+	return nil
+}
+
+// changed 判断证书文件是否有修改
+func (m *CertManager) changed() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, file := range m.files {
+		modTime, err := file.stat()
+		if err != nil {
+			return false, err
+		}
+		if !modTime.Equal(file.modTime) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Watch 定时检查证书文件，修改后自动重新加载
+// 加载失败时保留原有证书并调用onError，返回停止检查的方法，停止方法等待检查协程退出后返回
+// interval<=0时不检查
+func (m *CertManager) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	return watcher.Watch(interval, m.reloadIfChanged, onError)
+}
+
+// reloadIfChanged 证书文件修改后重新加载
+func (m *CertManager) reloadIfChanged() error {
+	changed, err := m.changed()
+	if err != nil || !changed {
+		return err
+	}
+	return m.Reload()
+}
+
+// GetCertificate 按SNI返回证书，用于tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := m.certs.Load().(*certSet)
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := set.byName[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := set.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if set.defaultCert == nil {
+		return nil, errors.New("no tls certificate")
+	}
+	return set.defaultCert, nil
+}
+
+// add 添加证书，同一域名先添加的证书优先
+func (s *certSet) add(cert *tls.Certificate) {
+	if s.defaultCert == nil {
+		s.defaultCert = cert
+	}
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, exist := s.byName[name]; !exist {
+			s.byName[name] = cert
+		}
+	}
+}
+
+// stat 获取证书及私钥文件中较新的修改时间
+func (f *certFile) stat() (time.Time, error) {
+	certInfo, err := os.Stat(f.certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(f.keyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// SetCertManager 设置证书管理器，按SNI选择证书，tls配置中原有的证书不再使用
+// interval>0时定时检查证书文件，修改后自动重新加载，加载失败时通过onError通知
+func (server *Server) SetCertManager(manager *CertManager, interval time.Duration) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if server.tlsConfig == nil {
+		server.tlsConfig = &tls.Config{}
+	} else {
+		server.tlsConfig = server.tlsConfig.Clone()
+	}
+	server.tlsConfig.Certificates = nil
+	server.tlsConfig.GetCertificate = manager.GetCertificate
+	server.certManager = manager
+	server.certWatchInterval = interval
+	return nil
+}
+
+// watchCertificates 开始检查证书文件，返回停止检查的方法
+func (server *Server) watchCertificates() func() {
+	if server.certManager == nil || server.certWatchInterval <= 0 {
+		return func() {}
+	}
+	return server.certManager.Watch(server.certWatchInterval, func(err error) {
+		server.handleOnError(newError(PhaseAccept, nil, err, "reload tls certificate error"))
+	})
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -9,6 +10,8 @@ import (
 
 	"github.com/pkg/errors"
 	goserver "github.com/zboyco/go-server"
+	"github.com/zboyco/go-server/arq"
+	"github.com/zboyco/go-server/fragment"
 )
 
 type SimpleClient struct {
@@ -21,6 +24,9 @@ type SimpleClient struct {
 	maxScanTokenSize int
 	scanner          *bufio.Scanner
 	split            bufio.SplitFunc
+	reliable         bool             // 是否使用可靠udp
+	arqConfig        *arq.Config      // 可靠udp传输参数
+	fragmentConfig   *fragment.Config // udp分片参数
 
 	sync.Mutex
 }
@@ -50,6 +56,19 @@ func (client *SimpleClient) SetScannerSplitFunc(split bufio.SplitFunc) {
 	client.split = split
 }
 
+// SetReliableUDP 设置使用可靠udp传输，需与服务端UDPModeReliable模式配合
+// config为nil时使用默认参数
+func (client *SimpleClient) SetReliableUDP(config *arq.Config) {
+	client.reliable = true
+	client.arqConfig = config
+}
+
+// SetUDPFragmentation 设置udp分片，需与服务端SetUDPFragmentation配合
+// 开启后每次Send的数据作为一个消息分片发送，接收时重组为完整消息
+func (client *SimpleClient) SetUDPFragmentation(config *fragment.Config) {
+	client.fragmentConfig = config
+}
+
 // Connect 连接
 func (client *SimpleClient) Connect() error {
 	client.Lock()
@@ -82,12 +101,38 @@ func (client *SimpleClient) Connect() error {
 		if err != nil {
 			return errors.Wrap(err, "DialUDP error")
 		}
+		if client.reliable {
+			conn = arq.Client(conn, client.arqConfig)
+		} else if client.fragmentConfig != nil {
+			conn = fragment.NewConn(conn, client.fragmentConfig)
+		}
 	}
 
 	client.conn = conn
 	return nil
 }
 
+// StartTLS 将明文连接升级为tls，需与服务端AppSession.StartTLS配合
+// 应在收到服务端同意升级的响应后调用，升级后重新创建scanner
+func (client *SimpleClient) StartTLS(config *tls.Config) error {
+	client.Lock()
+	defer client.Unlock()
+
+	if client.conn == nil {
+		return errors.New("conn is nil")
+	}
+	if client.network != goserver.TCP {
+		return errors.New("start tls only supports tcp")
+	}
+	tlsConn := tls.Client(client.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return errors.Wrap(err, "tls handshake error")
+	}
+	client.conn = tlsConn
+	client.scanner = nil
+	return nil
+}
+
 // GetRawConn 获取原始连接
 func (client *SimpleClient) GetRawConn() net.Conn {
 	return client.conn
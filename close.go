@@ -0,0 +1,85 @@
+package goserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// CloseKind 会话关闭原因类型
+type CloseKind int
+
+const (
+	CloseEOF            CloseKind = iota + 1 // 客户端关闭连接
+	CloseIdleTimeout                         // 闲置超时
+	CloseReadError                           // 读取错误，如连接被重置
+	CloseProtocolError                       // 协议错误，拆包或解析请求方法失败
+	CloseServerShutdown                      // 服务停止
+	CloseKicked                              // 应用调用Close关闭
+	CloseWriteFailed                         // 发送数据失败
+	CloseRejected                            // 被服务拒绝，如封禁、限流或认证失败
+)
+
+// String 返回关闭原因类型描述
+func (kind CloseKind) String() string {
+	switch kind {
+	case CloseEOF:
+		return "eof"
+	case CloseIdleTimeout:
+		return "idle_timeout"
+	case CloseReadError:
+		return "read_error"
+	case CloseProtocolError:
+		return "protocol_error"
+	case CloseServerShutdown:
+		return "server_shutdown"
+	case CloseKicked:
+		return "kicked"
+	case CloseWriteFailed:
+		return "write_failed"
+	case CloseRejected:
+		return "rejected"
+	default:
+		return fmt.Sprintf("close_kind(%d)", int(kind))
+	}
+}
+
+// CloseReason 会话关闭原因
+type CloseReason struct {
+	Kind CloseKind // 关闭原因类型
+	Err  error     // 导致关闭的错误，应用调用Close时为nil
+	Text string    // 关闭原因描述，与SetOnSessionClosed收到的字符串相同
+}
+
+// String 返回关闭原因描述
+func (reason *CloseReason) String() string {
+	return reason.Text
+}
+
+// newCloseReason 根据错误生成关闭原因
+func newCloseReason(kind CloseKind, err error) *CloseReason {
+	return &CloseReason{Kind: kind, Err: err, Text: err.Error()}
+}
+
+// readCloseReason 根据读取或处理数据时的错误生成关闭原因
+func readCloseReason(err error) *CloseReason {
+	var netErr net.Error
+	var phaseErr *Error
+	switch {
+	case err == io.EOF:
+		return newCloseReason(CloseEOF, err)
+	case errors.As(err, &phaseErr) && phaseErr.Phase == PhaseAuth,
+		errors.Is(err, ErrUnauthenticated), errors.Is(err, ErrForbidden):
+		// 认证阶段的错误均视为拒绝
+		return newCloseReason(CloseRejected, err)
+	case isProtocolError(err):
+		return newCloseReason(CloseProtocolError, err)
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return newCloseReason(CloseIdleTimeout, err)
+	default:
+		return newCloseReason(CloseReadError, err)
+	}
+}
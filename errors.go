@@ -1,10 +1,112 @@
 package goserver
 
-import "errors"
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
 
 var (
-	ErrServerRunning  error = errors.New("server is running")
-	ErrPathFormat     error = errors.New("path must start with \"/\"")
-	ErrActionNotFound error = errors.New("action not exist")
-	ErrActionConflict error = errors.New("action register conflict")
+	ErrServerRunning    error = errors.New("server is running")
+	ErrPathFormat       error = errors.New("path must start with \"/\"")
+	ErrActionNotFound   error = errors.New("action not exist")
+	ErrActionConflict   error = errors.New("action register conflict")
+	ErrServerNotRunning error = errors.New("server is not running")
+	ErrMulticastAddress error = errors.New("invalid multicast address")
+	ErrRateLimited      error = errors.New("rate limit exceeded")
+	ErrStartTLS         error = errors.New("session can not start tls")
+	ErrUnauthenticated  error = errors.New("session not authenticated")
+	ErrAuthTimeout      error = errors.New("authentication timeout")
+	ErrForbidden        error = errors.New("permission denied")
+	ErrRegisterTimeout  error = errors.New("session register timeout")
+	ErrMigrationDenied  error = errors.New("udp session migration denied")
+)
+
+// ErrorPhase 错误发生的阶段
+type ErrorPhase int
+
+const (
+	PhaseAccept     ErrorPhase = iota + 1 // 监听及接收连接，包括PROXY头部、tls握手及证书加载
+	PhaseFilter                           // 连接过滤器拒绝连接
+	PhaseSplit                            // 读取及拆包
+	PhaseResolve                          // 解析请求方法
+	PhaseAuth                             // 认证
+	PhaseMiddleware                       // 执行中间件或限流
+	PhaseAction                           // 执行action
+	PhaseSend                             // 发送数据
 )
+
+// String 返回阶段描述
+func (phase ErrorPhase) String() string {
+	switch phase {
+	case PhaseAccept:
+		return "accept"
+	case PhaseFilter:
+		return "filter"
+	case PhaseSplit:
+		return "split"
+	case PhaseResolve:
+		return "resolve"
+	case PhaseAuth:
+		return "auth"
+	case PhaseMiddleware:
+		return "middleware"
+	case PhaseAction:
+		return "action"
+	case PhaseSend:
+		return "send"
+	default:
+		return fmt.Sprintf("phase(%d)", int(phase))
+	}
+}
+
+// Error 服务处理过程中产生的错误，可以通过errors.Is及errors.As判断原始错误
+type Error struct {
+	Phase      ErrorPhase  // 错误发生的阶段
+	Session    *AppSession // 发生错误的会话，会话建立前为nil
+	RemoteAddr net.Addr    // 客户端地址，监听错误时为nil
+	Action     string      // 正在执行的action路径
+	Err        error       // 原始错误
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError 新建错误，message不为空时附加到原始错误
+func newError(phase ErrorPhase, session *AppSession, err error, message string) *Error {
+	if message != "" {
+		err = errors.Wrap(err, message)
+	}
+	e := &Error{Phase: phase, Session: session, Err: err}
+	if session != nil {
+		e.RemoteAddr = session.RemoteAddr()
+	}
+	return e
+}
+
+// wrapError 附加错误信息，err中已包含*Error时沿用其阶段及action
+func wrapError(phase ErrorPhase, session *AppSession, err error, message string) *Error {
+	if e, ok := err.(*Error); ok && message == "" {
+		return e
+	}
+	e := newError(phase, session, err, message)
+	var inner *Error
+	if errors.As(err, &inner) {
+		e.Phase = inner.Phase
+		e.Action = inner.Action
+	}
+	return e
+}
+
+// newAddrError 新建会话建立前的错误
+func newAddrError(phase ErrorPhase, addr net.Addr, err error, message string) *Error {
+	e := newError(phase, nil, err, message)
+	e.RemoteAddr = addr
+	return e
+}
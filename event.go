@@ -0,0 +1,231 @@
+package goserver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType 事件类型
+type EventType int
+
+const (
+	EventSessionOpened        EventType = iota + 1 // 会话建立
+	EventSessionAuthenticated                      // 会话认证成功
+	EventSessionClosed                             // 会话关闭
+	EventMessageReceived                           // 接收一个拆包后的消息
+	EventMessageSent                               // 发送数据
+	EventError                                     // 产生错误
+	EventServerStarted                             // 服务开始监听
+	EventServerStopping                            // 服务开始停止
+)
+
+// String 返回事件类型描述
+func (t EventType) String() string {
+	switch t {
+	case EventSessionOpened:
+		return "session_opened"
+	case EventSessionAuthenticated:
+		return "session_authenticated"
+	case EventSessionClosed:
+		return "session_closed"
+	case EventMessageReceived:
+		return "message_received"
+	case EventMessageSent:
+		return "message_sent"
+	case EventError:
+		return "error"
+	case EventServerStarted:
+		return "server_started"
+	case EventServerStopping:
+		return "server_stopping"
+	default:
+		return fmt.Sprintf("event(%d)", int(t))
+	}
+}
+
+// Event 事件
+type Event struct {
+	Type     EventType    // 事件类型
+	Time     time.Time    // 事件发生时间
+	Session  *AppSession  // 会话相关事件的会话
+	Action   string       // 消息事件的action路径
+	Data     []byte       // 消息事件的数据，接收时为解析请求方法后的数据
+	Identity *Identity    // EventSessionAuthenticated的认证身份
+	Reason   *CloseReason // EventSessionClosed的关闭原因
+	Err      *Error       // EventError的错误
+}
+
+// EventHandler 事件处理方法
+type EventHandler func(event *Event)
+
+// SubscribeOptions 订阅选项
+type SubscribeOptions struct {
+	Types     []EventType // 订阅的事件类型，为空时订阅全部事件
+	Async     bool        // 是否异步投递，异步时事件进入队列由单独的协程依次处理，否则在产生事件的协程中调用
+	QueueSize int         // 异步投递的队列长度，默认1024，队列满时丢弃事件
+}
+
+// Subscription 事件订阅
+type Subscription struct {
+	bus     *eventBus
+	handler EventHandler
+	types   map[EventType]bool
+	queue   chan *Event // 异步投递队列，同步投递时为nil
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Int64
+}
+
+// Unsubscribe 取消订阅，异步投递时队列中未处理的事件将被丢弃
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.bus.remove(s)
+		close(s.done)
+	})
+}
+
+// Dropped 获取异步投递时因队列已满丢弃的事件数量
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// accept 是否订阅了事件类型
+func (s *Subscription) accept(t EventType) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// deliver 投递事件
+func (s *Subscription) deliver(event *Event) {
+	if s.queue == nil {
+		s.handler(event)
+		return
+	}
+	select {
+	case <-s.done:
+	case s.queue <- event:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run 异步投递协程
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.queue:
+			s.handler(event)
+		}
+	}
+}
+
+// eventBus 事件总线，订阅列表写时复制，发布时无需加锁
+type eventBus struct {
+	subscriptions atomic.Value // []*Subscription
+	sync.Mutex
+}
+
+// newEventBus 新建事件总线
+func newEventBus() *eventBus {
+	bus := &eventBus{}
+	bus.subscriptions.Store([]*Subscription(nil))
+	return bus
+}
+
+// load 获取当前订阅列表
+func (bus *eventBus) load() []*Subscription {
+	return bus.subscriptions.Load().([]*Subscription)
+}
+
+// add 添加订阅
+func (bus *eventBus) add(s *Subscription) {
+	bus.Lock()
+	defer bus.Unlock()
+	subscriptions := bus.load()
+	next := make([]*Subscription, 0, len(subscriptions)+1)
+	next = append(next, subscriptions...)
+	bus.subscriptions.Store(append(next, s))
+}
+
+// remove 移除订阅
+func (bus *eventBus) remove(s *Subscription) {
+	bus.Lock()
+	defer bus.Unlock()
+	subscriptions := bus.load()
+	next := make([]*Subscription, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		if subscription != s {
+			next = append(next, subscription)
+		}
+	}
+	bus.subscriptions.Store(next)
+}
+
+// subscribed 是否有订阅者订阅了事件类型，用于在没有订阅者时避免创建事件
+func (bus *eventBus) subscribed(t EventType) bool {
+	if bus == nil {
+		return false
+	}
+	for _, s := range bus.load() {
+		if s.accept(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish 发布事件
+func (bus *eventBus) publish(event *Event) {
+	if bus == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, s := range bus.load() {
+		if s.accept(event.Type) {
+			s.deliver(event)
+		}
+	}
+}
+
+// publishMessage 发布消息事件，异步投递时数据可能已被复用，因此复制数据
+func (bus *eventBus) publishMessage(t EventType, session *AppSession, action string, data []byte) {
+	if !bus.subscribed(t) {
+		return
+	}
+	bus.publish(&Event{
+		Type:    t,
+		Session: session,
+		Action:  action,
+		Data:    append([]byte(nil), data...),
+	})
+}
+
+// Subscribe 订阅服务事件，可以在服务运行时订阅及取消订阅
+// 同步投递的处理方法应尽快返回，避免阻塞会话的处理
+func (server *Server) Subscribe(handler EventHandler, options SubscribeOptions) *Subscription {
+	s := &Subscription{
+		bus:     server.events,
+		handler: handler,
+		done:    make(chan struct{}),
+	}
+	if len(options.Types) > 0 {
+		s.types = make(map[EventType]bool, len(options.Types))
+		for _, t := range options.Types {
+			s.types[t] = true
+		}
+	}
+	if options.Async {
+		if options.QueueSize <= 0 {
+			options.QueueSize = 1024
+		}
+		s.queue = make(chan *Event, options.QueueSize)
+		go s.run()
+	}
+	server.events.add(s)
+	return s
+}
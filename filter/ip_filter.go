@@ -0,0 +1,307 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zboyco/go-server/internal/watcher"
+)
+
+// ErrIPDenied IP被拒绝
+var ErrIPDenied = errors.New("ip denied")
+
+const (
+	ruleNone  int8 = iota // 无规则
+	ruleAllow             // 允许
+	ruleDeny              // 拒绝
+)
+
+// ipTrie 按位存储网段的前缀树，用于最长前缀匹配
+type ipTrie struct {
+	children [2]*ipTrie
+	rule     int8
+}
+
+// insert 插入网段规则，同一网段拒绝优先
+func (t *ipTrie) insert(ip net.IP, ones int, rule int8) {
+	node := t
+	for i := 0; i < ones; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrie{}
+		}
+		node = node.children[bit]
+	}
+	if node.rule != ruleDeny {
+		node.rule = rule
+	}
+}
+
+// lookup 返回最长前缀匹配的规则
+func (t *ipTrie) lookup(ip net.IP) int8 {
+	rule := t.rule
+	node := t
+	for i := 0; i < len(ip)*8; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		node = node.children[bit]
+		if node == nil {
+			break
+		}
+		if node.rule != ruleNone {
+			rule = node.rule
+		}
+	}
+	return rule
+}
+
+// ipRules 一组编译后的规则
+type ipRules struct {
+	v4       *ipTrie
+	v6       *ipTrie
+	hasAllow bool // 存在允许规则时，未匹配的IP被拒绝
+}
+
+// newIPRules 编译规则
+func newIPRules(allow, deny []string) (*ipRules, error) {
+	rules := &ipRules{
+		v4: &ipTrie{},
+		v6: &ipTrie{},
+	}
+	for _, item := range allow {
+		if err := rules.add(item, ruleAllow); err != nil {
+			return nil, err
+		}
+		rules.hasAllow = true
+	}
+	for _, item := range deny {
+		if err := rules.add(item, ruleDeny); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// add 添加单个IP或CIDR规则
+func (r *ipRules) add(item string, rule int8) error {
+	item = strings.TrimSpace(item)
+	var (
+		ip   net.IP
+		ones int
+	)
+	if strings.Contains(item, "/") {
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		ip = ipNet.IP
+		ones, _ = ipNet.Mask.Size()
+	} else {
+		ip = net.ParseIP(item)
+		if ip == nil {
+			return &net.ParseError{Type: "IP address", Text: item}
+		}
+		ones = len(ip) * 8
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if len(ip) == net.IPv6len && ones >= 96 {
+			ones -= 96
+		}
+		r.v4.insert(ip4, ones, rule)
+		return nil
+	}
+	r.v6.insert(ip.To16(), ones, rule)
+	return nil
+}
+
+// allowed 判断IP是否允许
+func (r *ipRules) allowed(ip net.IP) bool {
+	var rule int8
+	if ip4 := ip.To4(); ip4 != nil {
+		rule = r.v4.lookup(ip4)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		rule = r.v6.lookup(ip16)
+	} else {
+		return false
+	}
+	switch rule {
+	case ruleAllow:
+		return true
+	case ruleDeny:
+		return false
+	default:
+		return !r.hasAllow
+	}
+}
+
+// IPFilter 基于CIDR的IP访问控制过滤器，可同时用于TCP及UDP
+// 按最长前缀匹配规则，同一网段拒绝优先；未匹配任何规则时，存在允许规则则拒绝，否则允许
+// 规则可在运行时原子更新
+type IPFilter struct {
+	rules atomic.Value // *ipRules
+
+	path    string     // 规则文件路径
+	modTime time.Time  // 规则文件修改时间
+	mu      sync.Mutex // 规则文件锁
+}
+
+// NewIPFilter 新建IP过滤器，规则为IP或CIDR
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	if err := f.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewIPFilterFromFile 从规则文件新建IP过滤器
+// 文件每行一条规则，格式为 allow|deny IP或CIDR，#开头为注释
+func NewIPFilterFromFile(path string) (*IPFilter, error) {
+	f := &IPFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Update 原子替换全部规则
+func (f *IPFilter) Update(allow, deny []string) error {
+	rules, err := newIPRules(allow, deny)
+	if err != nil {
+		return err
+	}
+	f.rules.Store(rules)
+	return nil
+}
+
+// Reload 重新加载规则文件
+func (f *IPFilter) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.path == "" {
+		return errors.New("ip filter has no rule file")
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	allow, deny, err := readIPRuleFile(f.path)
+	if err != nil {
+		return err
+	}
+	if err := f.Update(allow, deny); err != nil {
+		return err
+	}
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// Watch 定时检查规则文件，修改后自动重新加载
+// 加载失败时保留原有规则并调用onError，返回停止检查的方法，停止方法等待检查协程退出后返回
+// interval<=0时不检查
+func (f *IPFilter) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	return watcher.Watch(interval, f.reloadIfChanged, onError)
+}
+
+// reloadIfChanged 规则文件修改后重新加载
+func (f *IPFilter) reloadIfChanged() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	changed := !info.ModTime().Equal(f.modTime)
+	f.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	return f.Reload()
+}
+
+// Allowed 判断IP是否允许
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	return f.rules.Load().(*ipRules).allowed(ip)
+}
+
+// TCP 返回TCP连接过滤器
+func (f *IPFilter) TCP() ConnectionFilterTCP {
+	return func(conn net.Conn) error {
+		return f.check(conn.RemoteAddr())
+	}
+}
+
+// UDP 返回UDP连接过滤器
+func (f *IPFilter) UDP() ConnectionFilterUDP {
+	return func(addr *net.UDPAddr) error {
+		return f.check(addr)
+	}
+}
+
+// check 检查地址
+func (f *IPFilter) check(addr net.Addr) error {
+	ip := AddrIP(addr)
+	if ip == nil || !f.Allowed(ip) {
+		return ErrIPDenied
+	}
+	return nil
+}
+
+// AddrIP 获取地址中的IP
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// readIPRuleFile 读取规则文件
+func readIPRuleFile(path string) (allow, deny []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("%s:%d: invalid rule %q", path, line, text)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: invalid rule %q", path, line, text)
+		}
+	}
+	return allow, deny, scanner.Err()
+}
@@ -0,0 +1,91 @@
+package filter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := NewIPFilter(
+		[]string{"10.0.0.0/8", "2001:db8::/32"},
+		[]string{"10.1.0.0/16", "10.1.2.3"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.3.4":        false,
+		"10.1.2.3":        false,
+		"192.168.0.1":     false,
+		"::ffff:10.2.3.4": true,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+	}
+	for ip, expected := range cases {
+		if allowed := f.Allowed(net.ParseIP(ip)); allowed != expected {
+			t.Errorf("%s: expected %v, got %v", ip, expected, allowed)
+		}
+	}
+
+	// 更长的允许规则优先于拒绝规则
+	if err := f.Update([]string{"10.1.2.0/24"}, []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allowed(net.ParseIP("10.1.2.9")) || f.Allowed(net.ParseIP("10.1.3.9")) {
+		t.Error("longest prefix match failed")
+	}
+
+	// 仅拒绝规则时默认允许
+	if err := f.Update(nil, []string{"192.168.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("expected default allow")
+	}
+	if err := f.UDP()(&net.UDPAddr{IP: net.ParseIP("192.168.1.1")}); err != ErrIPDenied {
+		t.Errorf("expected ip denied, got %v", err)
+	}
+
+	if err := f.Update([]string{"300.0.0.1"}, nil); err == nil {
+		t.Error("expected invalid rule error")
+	}
+}
+
+func TestIPFilterFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip.rules")
+	if err := os.WriteFile(path, []byte("# 内网\nallow 10.0.0.0/8\ndeny 10.0.0.1 # 网关\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewIPFilterFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allowed(net.ParseIP("10.0.0.2")) || f.Allowed(net.ParseIP("10.0.0.1")) {
+		t.Fatal("unexpected rules from file")
+	}
+
+	stop := f.Watch(10*time.Millisecond, func(err error) {
+		t.Error(err)
+	})
+	defer stop()
+
+	if err := os.WriteFile(path, []byte("allow 192.168.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	deadline := time.Now().Add(2 * time.Second)
+	for f.Allowed(net.ParseIP("10.0.0.2")) {
+		if time.Now().After(deadline) {
+			t.Fatal("rule file not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !f.Allowed(net.ParseIP("192.168.1.1")) {
+		t.Fatal("unexpected reloaded rules")
+	}
+}
@@ -0,0 +1,70 @@
+package fragment
+
+import (
+	"net"
+)
+
+// Conn 对已连接的UDP socket进行分片及重组
+// Write 写入的每个消息拆分为分片发送，Read 每次返回一个重组后的完整消息
+type Conn struct {
+	net.Conn
+	splitter    *Splitter
+	reassembler *Reassembler
+	buffer      []byte // 重组后尚未读取的数据
+	readBuffer  []byte
+}
+
+// NewConn 基于已连接的UDP socket新建分片连接，config为nil时使用默认参数
+func NewConn(conn net.Conn, config *Config) *Conn {
+	cfg := config.withDefaults()
+	return &Conn{
+		Conn:        conn,
+		splitter:    NewSplitter(&cfg),
+		reassembler: NewReassembler(&cfg),
+		readBuffer:  make([]byte, 64*1024),
+	}
+}
+
+// Read 读取重组后的消息，p长度不足时剩余部分在下次读取返回
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.buffer) == 0 {
+		n, err := c.Conn.Read(c.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+		// 未分片的数据报按原样返回
+		if !IsFragment(c.readBuffer[:n]) {
+			c.buffer = append([]byte(nil), c.readBuffer[:n]...)
+			continue
+		}
+		message, err := c.reassembler.Input(c.readBuffer[:n])
+		if err != nil {
+			// 忽略无效分片
+			continue
+		}
+		c.buffer = message
+	}
+	n := copy(p, c.buffer)
+	c.buffer = c.buffer[n:]
+	return n, nil
+}
+
+// Write 将p作为一个消息分片发送
+func (c *Conn) Write(p []byte) (int, error) {
+	fragments, err := c.splitter.Split(p)
+	if err != nil {
+		return 0, err
+	}
+	for _, fragment := range fragments {
+		if _, err := c.Conn.Write(fragment); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close 关闭连接并清理未完成重组的消息
+func (c *Conn) Close() error {
+	c.reassembler.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,323 @@
+// Package fragment 实现UDP消息分片及重组
+// 每个分片头部依次为 magic(2) 消息ID(4) 分片序号(2) 分片总数(2) 校验和(4)
+// 校验和为头部其余字段及数据的CRC32，magic及校验和均匹配的数据报才视为分片
+package fragment
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	magic      uint16 = 0xF54D // 分片标记
+	headerSize        = 14     // 分片头部长度
+	maxTotal          = 0xFFFF
+)
+
+var (
+	ErrInvalidFragment = errors.New("fragment: invalid fragment")
+	ErrMessageTooLarge = errors.New("fragment: message too large")
+	ErrPendingLimit    = errors.New("fragment: pending reassembly limit exceeded")
+)
+
+// Config 分片参数
+type Config struct {
+	FragmentSize    int           // 单个分片最大长度(含头部)，应小于路径MTU，默认1200
+	Timeout         time.Duration // 未完成重组的消息超时时间，默认5s
+	MaxMessageSize  int           // 单个消息最大长度，默认1MiB
+	MaxPending      int           // 单个重组器未完成重组的消息占用的最大字节数，默认4MiB
+	MaxGroupPending int           // 同一Group中所有重组器未完成重组的消息占用的最大字节数，默认64MiB
+}
+
+// withDefaults 返回填充默认值后的配置
+func (cfg *Config) withDefaults() Config {
+	c := Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.FragmentSize <= headerSize {
+		c.FragmentSize = 1200
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = 1024 * 1024
+	}
+	if c.MaxPending <= 0 {
+		c.MaxPending = 4 * 1024 * 1024
+	}
+	if c.MaxGroupPending <= 0 {
+		c.MaxGroupPending = 64 * 1024 * 1024
+	}
+	return c
+}
+
+// IsFragment 判断数据报是否为分片，未分片的数据报可按原样处理
+func IsFragment(datagram []byte) bool {
+	_, _, _, _, ok := decode(datagram)
+	return ok
+}
+
+// encode 编码分片
+func encode(id uint32, index, total int, data []byte) []byte {
+	fragment := make([]byte, headerSize, headerSize+len(data))
+	binary.BigEndian.PutUint16(fragment[0:], magic)
+	binary.BigEndian.PutUint32(fragment[2:], id)
+	binary.BigEndian.PutUint16(fragment[6:], uint16(index))
+	binary.BigEndian.PutUint16(fragment[8:], uint16(total))
+	fragment = append(fragment, data...)
+	binary.BigEndian.PutUint32(fragment[10:], checksum(fragment))
+	return fragment
+}
+
+// decode 解析分片，magic或校验和不匹配时返回false
+func decode(fragment []byte) (id uint32, index, total int, data []byte, ok bool) {
+	if len(fragment) < headerSize || binary.BigEndian.Uint16(fragment) != magic {
+		return 0, 0, 0, nil, false
+	}
+	if binary.BigEndian.Uint32(fragment[10:]) != checksum(fragment) {
+		return 0, 0, 0, nil, false
+	}
+	id = binary.BigEndian.Uint32(fragment[2:])
+	index = int(binary.BigEndian.Uint16(fragment[6:]))
+	total = int(binary.BigEndian.Uint16(fragment[8:]))
+	return id, index, total, fragment[headerSize:], true
+}
+
+// checksum 计算头部其余字段及数据的CRC32
+func checksum(fragment []byte) uint32 {
+	sum := crc32.ChecksumIEEE(fragment[:10])
+	return crc32.Update(sum, crc32.IEEETable, fragment[headerSize:])
+}
+
+// Splitter 消息分片器，可并发使用
+type Splitter struct {
+	cfg    Config
+	nextID uint32
+}
+
+// NewSplitter 新建分片器，config为nil时使用默认参数
+func NewSplitter(config *Config) *Splitter {
+	return &Splitter{
+		cfg: config.withDefaults(),
+	}
+}
+
+// Split 将消息拆分为分片
+func (s *Splitter) Split(payload []byte) ([][]byte, error) {
+	if len(payload) > s.cfg.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	size := s.cfg.FragmentSize - headerSize
+	total := (len(payload) + size - 1) / size
+	if total == 0 {
+		total = 1
+	}
+	if total > maxTotal {
+		return nil, ErrMessageTooLarge
+	}
+
+	id := atomic.AddUint32(&s.nextID, 1)
+	fragments := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		start := i * size
+		end := start + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		fragments = append(fragments, encode(id, i, total, payload[start:end]))
+	}
+	return fragments, nil
+}
+
+// partial 未完成重组的消息
+type partial struct {
+	parts    [][]byte
+	received int
+	size     int
+	deadline time.Time
+}
+
+// Reassembler 分片重组器，每个对端使用一个，可并发使用
+// 超时的消息由定时器清理，不再使用时应调用Close释放
+type Reassembler struct {
+	cfg     Config
+	pending map[uint32]*partial
+	size    int         // 未完成重组的消息占用字节数
+	group   *Group      // 所属的重组器组，为nil时不限制总量
+	timer   *time.Timer // 超时清理定时器，没有未完成的消息时为nil
+	closed  bool        // 是否已关闭
+
+	sync.Mutex
+}
+
+// NewReassembler 新建重组器，config为nil时使用默认参数
+func NewReassembler(config *Config) *Reassembler {
+	return &Reassembler{
+		cfg:     config.withDefaults(),
+		pending: make(map[uint32]*partial),
+	}
+}
+
+// Group 共享未完成消息总字节数限制的一组重组器，用于服务端为每个会话创建重组器
+type Group struct {
+	cfg  Config
+	size atomic.Int64 // 组内未完成重组的消息占用字节数
+}
+
+// NewGroup 新建重组器组，config为nil时使用默认参数
+func NewGroup(config *Config) *Group {
+	return &Group{
+		cfg: config.withDefaults(),
+	}
+}
+
+// NewReassembler 新建组内的重组器
+func (g *Group) NewReassembler() *Reassembler {
+	return &Reassembler{
+		cfg:     g.cfg,
+		pending: make(map[uint32]*partial),
+		group:   g,
+	}
+}
+
+// Pending 返回组内未完成重组的消息占用字节数
+func (g *Group) Pending() int {
+	return int(g.size.Load())
+}
+
+// Input 输入一个分片
+// 消息重组完成时返回完整消息，否则返回nil
+func (r *Reassembler) Input(fragment []byte) ([]byte, error) {
+	id, index, total, data, ok := decode(fragment)
+	if !ok || total == 0 || index >= total {
+		return nil, ErrInvalidFragment
+	}
+
+	// 单个分片无需重组
+	if total == 1 {
+		return append([]byte(nil), data...), nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return nil, nil
+	}
+
+	now := time.Now()
+	r.expire(now)
+
+	p, exist := r.pending[id]
+	if !exist {
+		p = &partial{
+			parts:    make([][]byte, total),
+			deadline: now.Add(r.cfg.Timeout),
+		}
+		r.pending[id] = p
+		r.schedule()
+	}
+	if len(p.parts) != total {
+		r.drop(id, p)
+		return nil, ErrInvalidFragment
+	}
+	if p.parts[index] != nil {
+		return nil, nil
+	}
+	if p.size+len(data) > r.cfg.MaxMessageSize {
+		r.drop(id, p)
+		return nil, ErrMessageTooLarge
+	}
+	if r.size+len(data) > r.cfg.MaxPending {
+		r.drop(id, p)
+		return nil, ErrPendingLimit
+	}
+	if r.group != nil && r.group.size.Add(int64(len(data))) > int64(r.cfg.MaxGroupPending) {
+		r.group.size.Add(-int64(len(data)))
+		r.drop(id, p)
+		return nil, ErrPendingLimit
+	}
+
+	// 空分片也保存为非nil，避免重复到达时被再次计数
+	p.parts[index] = append(make([]byte, 0, len(data)), data...)
+	p.received++
+	p.size += len(data)
+	r.size += len(data)
+	if p.received < total {
+		return nil, nil
+	}
+
+	r.drop(id, p)
+	message := make([]byte, 0, p.size)
+	for _, part := range p.parts {
+		message = append(message, part...)
+	}
+	return message, nil
+}
+
+// Pending 返回未完成重组的消息数量
+func (r *Reassembler) Pending() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.pending)
+}
+
+// Close 清理全部未完成的消息并停止定时器，关闭后输入的分片被忽略
+func (r *Reassembler) Close() {
+	r.Lock()
+	defer r.Unlock()
+	r.closed = true
+	for id, p := range r.pending {
+		r.drop(id, p)
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// expire 清理超时的消息
+func (r *Reassembler) expire(now time.Time) {
+	for id, p := range r.pending {
+		if now.After(p.deadline) {
+			r.drop(id, p)
+		}
+	}
+}
+
+// schedule 存在未完成的消息时启动定时器，在最早的超时时间清理，需持有锁
+func (r *Reassembler) schedule() {
+	if r.timer != nil || len(r.pending) == 0 {
+		return
+	}
+	var deadline time.Time
+	for _, p := range r.pending {
+		if deadline.IsZero() || p.deadline.Before(deadline) {
+			deadline = p.deadline
+		}
+	}
+	r.timer = time.AfterFunc(time.Until(deadline)+time.Millisecond, func() {
+		r.Lock()
+		defer r.Unlock()
+		r.timer = nil
+		if r.closed {
+			return
+		}
+		r.expire(time.Now())
+		r.schedule()
+	})
+}
+
+// drop 移除未完成的消息
+func (r *Reassembler) drop(id uint32, p *partial) {
+	r.size -= p.size
+	if r.group != nil {
+		r.group.size.Add(-int64(p.size))
+	}
+	delete(r.pending, id)
+}
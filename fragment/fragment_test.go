@@ -0,0 +1,150 @@
+package fragment
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSplitReassemble(t *testing.T) {
+	cfg := &Config{FragmentSize: 105}
+	s := NewSplitter(cfg)
+	r := NewReassembler(cfg)
+
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	fragments, err := s.Split(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 11 {
+		t.Fatalf("expected 11 fragments, got %d", len(fragments))
+	}
+
+	// 乱序及重复到达
+	var message []byte
+	for i := len(fragments) - 1; i >= 0; i-- {
+		times := 2
+		if i == 0 {
+			times = 1
+		}
+		for j := 0; j < times; j++ {
+			result, err := r.Input(fragments[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != nil {
+				message = result
+			}
+		}
+	}
+	if !bytes.Equal(payload, message) {
+		t.Fatal("reassembled message mismatch")
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("expected no pending message, got %d", r.Pending())
+	}
+}
+
+func TestReassembleLimits(t *testing.T) {
+	cfg := &Config{FragmentSize: 25, MaxPending: 30, Timeout: 50 * time.Millisecond}
+	s := NewSplitter(cfg)
+	r := NewReassembler(cfg)
+
+	first, _ := s.Split(make([]byte, 100))
+	second, _ := s.Split(make([]byte, 100))
+	if _, err := r.Input(first[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Input(first[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Input(second[0]); err != ErrPendingLimit {
+		t.Fatalf("expected pending limit error, got %v", err)
+	}
+
+	// 超时后释放
+	time.Sleep(100 * time.Millisecond)
+	if _, err := r.Input(second[0]); err != nil {
+		t.Fatal(err)
+	}
+	if r.Pending() != 1 {
+		t.Fatalf("expected 1 pending message, got %d", r.Pending())
+	}
+
+	if _, err := r.Input([]byte("not a fragment")); err != ErrInvalidFragment {
+		t.Fatalf("expected invalid fragment error, got %v", err)
+	}
+}
+
+func TestReassembleGroup(t *testing.T) {
+	cfg := &Config{FragmentSize: 25, MaxGroupPending: 30, Timeout: 50 * time.Millisecond}
+	s := NewSplitter(cfg)
+	g := NewGroup(cfg)
+	first, second := g.NewReassembler(), g.NewReassembler()
+
+	fragments, _ := s.Split(make([]byte, 100))
+	if _, err := first.Input(fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Input(fragments[1]); err != nil {
+		t.Fatal(err)
+	}
+	// 超过组内总量限制
+	if _, err := second.Input(fragments[2]); err != ErrPendingLimit {
+		t.Fatalf("expected pending limit error, got %v", err)
+	}
+
+	// 无新分片输入时由定时器清理超时的消息
+	time.Sleep(100 * time.Millisecond)
+	if first.Pending() != 0 || g.Pending() != 0 {
+		t.Fatalf("expected expired messages released, got %d messages %d bytes", first.Pending(), g.Pending())
+	}
+
+	// 关闭后释放占用
+	if _, err := second.Input(fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+	if g.Pending() != 0 {
+		t.Fatalf("expected closed reassembler released, got %d bytes", g.Pending())
+	}
+	if IsFragment([]byte("not a fragment")) || !IsFragment(fragments[0]) {
+		t.Fatal("unexpected fragment detection")
+	}
+}
+
+func TestFragmentDetection(t *testing.T) {
+	fragments, _ := NewSplitter(nil).Split([]byte("hello"))
+	if !IsFragment(fragments[0]) {
+		t.Fatal("fragment not detected")
+	}
+
+	// 以分片标记开头的普通数据报校验和不匹配
+	datagram := append([]byte(nil), fragments[0]...)
+	datagram[len(datagram)-1] ^= 0xFF
+	if IsFragment(datagram) {
+		t.Fatal("corrupted fragment detected as fragment")
+	}
+	if _, err := NewReassembler(nil).Input(datagram); err != ErrInvalidFragment {
+		t.Fatalf("expected invalid fragment error, got %v", err)
+	}
+}
+
+func TestReassembleEmptyParts(t *testing.T) {
+	r := NewReassembler(nil)
+
+	// 重复到达的空分片不能提前完成重组
+	for i := 0; i < 3; i++ {
+		message, err := r.Input(encode(1, 0, 3, nil))
+		if err != nil || message != nil {
+			t.Fatalf("unexpected result %q %v", message, err)
+		}
+	}
+	if message, _ := r.Input(encode(1, 1, 3, []byte("ab"))); message != nil {
+		t.Fatalf("message completed early: %q", message)
+	}
+	message, err := r.Input(encode(1, 2, 3, []byte("c")))
+	if err != nil || string(message) != "abc" {
+		t.Fatalf("unexpected message %q %v", message, err)
+	}
+}
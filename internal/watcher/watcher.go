@@ -0,0 +1,41 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+// Watch 按间隔调用check检查文件，返回错误时调用onError，返回停止检查的方法
+// 停止方法会等待检查协程退出后返回，不能在check及onError中调用
+// interval<=0时不检查，返回的停止方法不做任何操作
+func Watch(interval time.Duration, check func() error, onError func(error)) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if err := check(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+		<-stopped
+	}
+}
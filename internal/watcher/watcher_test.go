@@ -0,0 +1,48 @@
+package watcher
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	var checks, errs atomic.Int64
+	stop := Watch(time.Millisecond, func() error {
+		if checks.Add(1)%2 == 0 {
+			return errors.New("check error")
+		}
+		return nil
+	}, func(err error) {
+		errs.Add(1)
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	stop()
+
+	// 停止后不再检查
+	count := checks.Load()
+	time.Sleep(10 * time.Millisecond)
+	if checks.Load() != count {
+		t.Fatal("check called after stop")
+	}
+	if count < 2 || errs.Load() != count/2 {
+		t.Fatalf("unexpected checks %d errors %d", count, errs.Load())
+	}
+}
+
+func TestWatchInvalidInterval(t *testing.T) {
+	var checks atomic.Int64
+	for _, interval := range []time.Duration{0, -time.Second} {
+		stop := Watch(interval, func() error {
+			checks.Add(1)
+			return nil
+		}, nil)
+		stop()
+	}
+	if checks.Load() != 0 {
+		t.Fatal("check called with invalid interval")
+	}
+}
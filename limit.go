@@ -0,0 +1,174 @@
+package goserver
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zboyco/go-server/filter"
+)
+
+// ConnectionLimit 连接限制
+type ConnectionLimit struct {
+	MaxSessions      int     // 最大会话数，<=0不限制
+	MaxSessionsPerIP int     // 单个IP(或网段)最大会话数，<=0不限制
+	IPv4PrefixLen    int     // 按网段统计时IPv4前缀长度，默认32即按单个IP统计
+	IPv6PrefixLen    int     // 按网段统计时IPv6前缀长度，默认128即按单个IP统计
+	Rate             float64 // 单个IP(或网段)每秒允许新建的连接数，<=0不限制
+	Burst            int     // 单个IP(或网段)允许突发的连接数，默认为Rate且不小于1
+}
+
+// RejectReason 连接被拒绝的原因
+type RejectReason int
+
+const (
+	RejectMaxSessions      RejectReason = iota + 1 // 超过最大会话数
+	RejectMaxSessionsPerIP                         // 超过单个IP最大会话数
+	RejectRateLimited                              // 新建连接过于频繁
+	rejectReasonCount
+)
+
+// String 返回原因描述
+func (reason RejectReason) String() string {
+	switch reason {
+	case RejectMaxSessions:
+		return "max sessions exceeded"
+	case RejectMaxSessionsPerIP:
+		return "max sessions per ip exceeded"
+	case RejectRateLimited:
+		return "connection rate limited"
+	default:
+		return "unknown"
+	}
+}
+
+// connectionLimiter 连接限制器
+type connectionLimiter struct {
+	limit    ConnectionLimit
+	buckets  *bucketSet               // 新建连接令牌桶
+	total    int                      // 当前会话数
+	perIP    map[string]int           // 每个IP(或网段)的会话数
+	rejected [rejectReasonCount]int64 // 各原因拒绝次数
+	sync.Mutex
+}
+
+// newConnectionLimiter 新建连接限制器
+func newConnectionLimiter(limit ConnectionLimit) *connectionLimiter {
+	if limit.IPv4PrefixLen <= 0 || limit.IPv4PrefixLen > 32 {
+		limit.IPv4PrefixLen = 32
+	}
+	if limit.IPv6PrefixLen <= 0 || limit.IPv6PrefixLen > 128 {
+		limit.IPv6PrefixLen = 128
+	}
+	l := &connectionLimiter{
+		limit: limit,
+		perIP: make(map[string]int),
+	}
+	if limit.Rate > 0 {
+		l.buckets = newBucketSet(limit.Rate, limit.Burst)
+	}
+	return l
+}
+
+// key 返回IP所在网段
+func (l *connectionLimiter) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.limit.IPv4PrefixLen, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(l.limit.IPv6PrefixLen, 128)).String()
+}
+
+// acquire 为新会话申请名额
+// 成功时返回释放名额的方法，失败时返回拒绝原因
+func (l *connectionLimiter) acquire(addr net.Addr) (func(), RejectReason) {
+	key := ""
+	if ip := filter.AddrIP(addr); ip != nil {
+		key = l.key(ip)
+	}
+
+	if l.buckets != nil && !l.buckets.allow(key) {
+		return nil, l.reject(RejectRateLimited)
+	}
+
+	l.Lock()
+	if l.limit.MaxSessions > 0 && l.total >= l.limit.MaxSessions {
+		l.Unlock()
+		return nil, l.reject(RejectMaxSessions)
+	}
+	if l.limit.MaxSessionsPerIP > 0 && l.perIP[key] >= l.limit.MaxSessionsPerIP {
+		l.Unlock()
+		return nil, l.reject(RejectMaxSessionsPerIP)
+	}
+	l.total++
+	l.perIP[key]++
+	l.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			l.total--
+			if l.perIP[key]--; l.perIP[key] <= 0 {
+				delete(l.perIP, key)
+			}
+		})
+	}, 0
+}
+
+// reject 记录拒绝次数
+func (l *connectionLimiter) reject(reason RejectReason) RejectReason {
+	atomic.AddInt64(&l.rejected[reason], 1)
+	return reason
+}
+
+// SetConnectionLimit 设置连接限制
+// tcp在接收连接时检查，udp在创建会话时检查
+func (server *Server) SetConnectionLimit(limit ConnectionLimit) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.connectionLimiter = newConnectionLimiter(limit)
+	return nil
+}
+
+// SetOnConnectionRejected 设置连接因限制被拒绝时处理方法
+func (server *Server) SetOnConnectionRejected(onConnectionRejectedFunc func(addr net.Addr, reason RejectReason)) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.onConnectionRejected = onConnectionRejectedFunc
+	return nil
+}
+
+// RejectedConnections 返回各原因被拒绝的连接次数
+func (server *Server) RejectedConnections() map[RejectReason]int64 {
+	result := make(map[RejectReason]int64)
+	if server.connectionLimiter == nil {
+		return result
+	}
+	for reason := RejectMaxSessions; reason < rejectReasonCount; reason++ {
+		result[reason] = atomic.LoadInt64(&server.connectionLimiter.rejected[reason])
+	}
+	return result
+}
+
+// acquireConnection 检查连接限制，返回释放名额的方法
+// 被拒绝时通知并返回false，拒绝可能大量发生(如udp洪泛)，只记录Debug日志，可通过指标及回调统计
+func (server *Server) acquireConnection(addr net.Addr) (func(), bool) {
+	if server.connectionLimiter == nil {
+		return nil, true
+	}
+	release, reason := server.connectionLimiter.acquire(addr)
+	if release == nil {
+		server.log().Debug("connection rejected", AttrRemoteAddr, addr.String(), AttrNetwork, string(server.network), "reason", reason.String())
+		server.metrics.ConnectionRejected(server.network, reason.String())
+		if server.onConnectionRejected != nil {
+			server.onConnectionRejected(addr, reason)
+		}
+		return nil, false
+	}
+	return release, true
+}
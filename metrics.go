@@ -0,0 +1,284 @@
+package goserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsRecorder 指标记录接口，可实现此接口对接其他监控系统
+type MetricsRecorder interface {
+	SessionOpened(network Network)                                  // 新建会话
+	SessionClosed(network Network)                                  // 关闭会话
+	BytesReceived(network Network, n int)                           // 接收字节数
+	BytesSent(network Network, n int)                               // 发送字节数
+	FrameReceived(network Network)                                  // 接收一个拆包后的消息
+	FrameSent(network Network)                                      // 发送一个消息
+	ActionHandled(action string, duration time.Duration, err error) // action执行完成
+	ErrorOccurred()                                                 // 发生错误
+	ConnectionRejected(network Network, reason string)              // 连接被拒绝
+}
+
+// nopMetricsRecorder 不记录指标
+type nopMetricsRecorder struct{}
+
+func (nopMetricsRecorder) SessionOpened(Network)                      {}
+func (nopMetricsRecorder) SessionClosed(Network)                      {}
+func (nopMetricsRecorder) BytesReceived(Network, int)                 {}
+func (nopMetricsRecorder) BytesSent(Network, int)                     {}
+func (nopMetricsRecorder) FrameReceived(Network)                      {}
+func (nopMetricsRecorder) FrameSent(Network)                          {}
+func (nopMetricsRecorder) ActionHandled(string, time.Duration, error) {}
+func (nopMetricsRecorder) ErrorOccurred()                             {}
+func (nopMetricsRecorder) ConnectionRejected(Network, string)         {}
+
+// DefaultLatencyBuckets 默认action耗时分布区间(秒)
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// networkMetrics 按传输协议统计的指标
+type networkMetrics struct {
+	sessionsOpened int64
+	sessionsClosed int64
+	bytesIn        int64
+	bytesOut       int64
+	framesIn       int64
+	framesOut      int64
+	rejected       map[string]int64
+}
+
+// actionMetrics 按action统计的指标
+type actionMetrics struct {
+	calls   int64
+	errors  int64
+	buckets []int64 // 各区间累计数量
+	sum     float64 // 总耗时(秒)
+}
+
+// Metrics 内置指标，实现MetricsRecorder，并以Prometheus文本格式输出
+type Metrics struct {
+	buckets  []float64
+	networks map[Network]*networkMetrics
+	actions  map[string]*actionMetrics
+	errors   int64
+	sync.Mutex
+}
+
+// NewMetrics 新建内置指标，buckets为action耗时分布区间(秒)，为空时使用DefaultLatencyBuckets
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		buckets:  buckets,
+		networks: make(map[Network]*networkMetrics),
+		actions:  make(map[string]*actionMetrics),
+	}
+}
+
+// network 获取传输协议指标，需持有锁
+func (m *Metrics) network(network Network) *networkMetrics {
+	nm, exist := m.networks[network]
+	if !exist {
+		nm = &networkMetrics{rejected: make(map[string]int64)}
+		m.networks[network] = nm
+	}
+	return nm
+}
+
+// SessionOpened 新建会话
+func (m *Metrics) SessionOpened(network Network) {
+	m.Lock()
+	m.network(network).sessionsOpened++
+	m.Unlock()
+}
+
+// SessionClosed 关闭会话
+func (m *Metrics) SessionClosed(network Network) {
+	m.Lock()
+	m.network(network).sessionsClosed++
+	m.Unlock()
+}
+
+// BytesReceived 接收字节数
+func (m *Metrics) BytesReceived(network Network, n int) {
+	m.Lock()
+	m.network(network).bytesIn += int64(n)
+	m.Unlock()
+}
+
+// BytesSent 发送字节数
+func (m *Metrics) BytesSent(network Network, n int) {
+	m.Lock()
+	m.network(network).bytesOut += int64(n)
+	m.Unlock()
+}
+
+// FrameReceived 接收一个消息
+func (m *Metrics) FrameReceived(network Network) {
+	m.Lock()
+	m.network(network).framesIn++
+	m.Unlock()
+}
+
+// FrameSent 发送一个消息
+func (m *Metrics) FrameSent(network Network) {
+	m.Lock()
+	m.network(network).framesOut++
+	m.Unlock()
+}
+
+// ActionHandled action执行完成
+func (m *Metrics) ActionHandled(action string, duration time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	am, exist := m.actions[action]
+	if !exist {
+		am = &actionMetrics{buckets: make([]int64, len(m.buckets))}
+		m.actions[action] = am
+	}
+	am.calls++
+	if err != nil {
+		am.errors++
+	}
+	seconds := duration.Seconds()
+	am.sum += seconds
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			am.buckets[i]++
+		}
+	}
+}
+
+// ErrorOccurred 发生错误
+func (m *Metrics) ErrorOccurred() {
+	m.Lock()
+	m.errors++
+	m.Unlock()
+}
+
+// ConnectionRejected 连接被拒绝
+func (m *Metrics) ConnectionRejected(network Network, reason string) {
+	m.Lock()
+	m.network(network).rejected[reason]++
+	m.Unlock()
+}
+
+// ServeHTTP 以Prometheus文本格式输出指标
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
+
+// WritePrometheus 以Prometheus文本格式写入指标
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	var buf bytes.Buffer
+
+	m.Lock()
+	networks := make([]string, 0, len(m.networks))
+	for network := range m.networks {
+		networks = append(networks, string(network))
+	}
+	sort.Strings(networks)
+	actions := make([]string, 0, len(m.actions))
+	for action := range m.actions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	networkCounter := func(name, help, metricType string, value func(nm *networkMetrics) int64) {
+		writeMetricHeader(&buf, name, help, metricType)
+		for _, network := range networks {
+			fmt.Fprintf(&buf, "%s{network=%q} %d\n", name, network, value(m.networks[Network(network)]))
+		}
+	}
+	networkCounter("goserver_sessions_opened_total", "Total number of sessions opened.", "counter", func(nm *networkMetrics) int64 { return nm.sessionsOpened })
+	networkCounter("goserver_sessions_closed_total", "Total number of sessions closed.", "counter", func(nm *networkMetrics) int64 { return nm.sessionsClosed })
+	networkCounter("goserver_sessions_active", "Number of active sessions.", "gauge", func(nm *networkMetrics) int64 { return nm.sessionsOpened - nm.sessionsClosed })
+	networkCounter("goserver_received_bytes_total", "Total number of bytes received.", "counter", func(nm *networkMetrics) int64 { return nm.bytesIn })
+	networkCounter("goserver_sent_bytes_total", "Total number of bytes sent.", "counter", func(nm *networkMetrics) int64 { return nm.bytesOut })
+	networkCounter("goserver_received_frames_total", "Total number of frames received.", "counter", func(nm *networkMetrics) int64 { return nm.framesIn })
+	networkCounter("goserver_sent_frames_total", "Total number of frames sent.", "counter", func(nm *networkMetrics) int64 { return nm.framesOut })
+
+	writeMetricHeader(&buf, "goserver_connections_rejected_total", "Total number of connections rejected.", "counter")
+	for _, network := range networks {
+		rejected := m.networks[Network(network)].rejected
+		reasons := make([]string, 0, len(rejected))
+		for reason := range rejected {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(&buf, "goserver_connections_rejected_total{network=%q,reason=%q} %d\n", network, reason, rejected[reason])
+		}
+	}
+
+	writeMetricHeader(&buf, "goserver_errors_total", "Total number of errors.", "counter")
+	fmt.Fprintf(&buf, "goserver_errors_total %d\n", m.errors)
+
+	writeMetricHeader(&buf, "goserver_action_calls_total", "Total number of action calls.", "counter")
+	for _, action := range actions {
+		fmt.Fprintf(&buf, "goserver_action_calls_total{action=%q} %d\n", action, m.actions[action].calls)
+	}
+	writeMetricHeader(&buf, "goserver_action_errors_total", "Total number of action calls returning an error.", "counter")
+	for _, action := range actions {
+		fmt.Fprintf(&buf, "goserver_action_errors_total{action=%q} %d\n", action, m.actions[action].errors)
+	}
+	writeMetricHeader(&buf, "goserver_action_duration_seconds", "Action handling latency in seconds.", "histogram")
+	for _, action := range actions {
+		am := m.actions[action]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(&buf, "goserver_action_duration_seconds_bucket{action=%q,le=%q} %d\n", action, strconv.FormatFloat(bound, 'g', -1, 64), am.buckets[i])
+		}
+		fmt.Fprintf(&buf, "goserver_action_duration_seconds_bucket{action=%q,le=\"+Inf\"} %d\n", action, am.calls)
+		fmt.Fprintf(&buf, "goserver_action_duration_seconds_sum{action=%q} %s\n", action, strconv.FormatFloat(am.sum, 'g', -1, 64))
+		fmt.Fprintf(&buf, "goserver_action_duration_seconds_count{action=%q} %d\n", action, am.calls)
+	}
+	m.Unlock()
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeMetricHeader 写入指标说明及类型
+func writeMetricHeader(buf *bytes.Buffer, name, help, metricType string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, metricType)
+}
+
+// meteredReader 统计会话读取的字节数
+type meteredReader struct {
+	r       io.Reader
+	session *AppSession
+	metrics MetricsRecorder
+}
+
+// Read 读取并记录字节数
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.session.received(n)
+		r.metrics.BytesReceived(r.session.network, n)
+	}
+	return n, err
+}
+
+// SetMetrics 设置指标记录器，可使用内置的NewMetrics
+func (server *Server) SetMetrics(recorder MetricsRecorder) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if recorder == nil {
+		recorder = nopMetricsRecorder{}
+	}
+	server.metrics = recorder
+	return nil
+}
@@ -0,0 +1,162 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrNoTrustedSources 未设置可信来源
+var ErrNoTrustedSources = errors.New("proxyproto: trusted sources required")
+
+// Config PROXY protocol参数
+type Config struct {
+	TrustedSources []string      // 允许携带PROXY头部的来源地址(IP或CIDR)，不能为空
+	HeaderTimeout  time.Duration // 读取头部超时时间，默认5s
+	Required       bool          // 可信来源的连接必须携带PROXY头部
+
+	trusted []*net.IPNet // Validate解析后的可信来源
+}
+
+// Validate 校验并解析可信来源，可信来源不能为空且必须为合法的IP或CIDR
+// 校验后NewConn不再重复解析
+func (config *Config) Validate() error {
+	trusted, err := parseSources(config.TrustedSources)
+	if err != nil {
+		return err
+	}
+	config.trusted = trusted
+	return nil
+}
+
+// Conn 解析PROXY头部后的连接
+// RemoteAddr和LocalAddr返回头部中的原始地址
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	header *Header
+}
+
+// NewConn 读取conn的PROXY头部并返回包装后的连接
+// 来源不可信时不读取头部，Header返回nil
+func NewConn(conn net.Conn, config *Config) (*Conn, error) {
+	c := &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	trusted := config.trusted
+	if trusted == nil {
+		var err error
+		if trusted, err = parseSources(config.TrustedSources); err != nil {
+			return nil, err
+		}
+	}
+	if !isTrusted(conn.RemoteAddr(), trusted) {
+		return c, nil
+	}
+
+	timeout := config.HeaderTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	header, err := Read(c.reader)
+	if err != nil {
+		// 非必须时，没有头部或未收到头部签名前等待超时均视为直连
+		// 已读取部分头部时返回ErrIncompleteHeader，不会视为直连
+		netErr, ok := err.(net.Error)
+		noHeader := err == ErrNoHeader || (ok && netErr.Timeout())
+		if config.Required || !noHeader {
+			return nil, err
+		}
+	}
+	c.header = header
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseSources 解析可信来源
+func parseSources(sources []string) ([]*net.IPNet, error) {
+	if len(sources) == 0 {
+		return nil, ErrNoTrustedSources
+	}
+	trusted := make([]*net.IPNet, 0, len(sources))
+	for _, source := range sources {
+		if _, ipNet, err := net.ParseCIDR(source); err == nil {
+			trusted = append(trusted, ipNet)
+			continue
+		}
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: source}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	return trusted, nil
+}
+
+// isTrusted 判断来源是否可信
+func isTrusted(addr net.Addr, trusted []*net.IPNet) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP 获取地址中的IP
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Header 返回PROXY头部，未携带时为nil
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// Read 读取数据
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr 返回客户端原始地址
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.SourceAddr != nil {
+		return c.header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回代理接收连接的原始地址
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header != nil && c.header.DestinationAddr != nil {
+		return c.header.DestinationAddr
+	}
+	return c.Conn.LocalAddr()
+}
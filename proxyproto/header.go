@@ -0,0 +1,283 @@
+// Package proxyproto 实现PROXY protocol v1及v2头部解析
+// 用于在负载均衡之后获取客户端的真实地址
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no proxy protocol header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid proxy protocol header")
+
+	// ErrIncompleteHeader 已读取部分头部后读取失败(如超时)，连接中的数据已被消耗
+	ErrIncompleteHeader = errors.New("proxyproto: incomplete proxy protocol header")
+)
+
+// v2Signature v2头部签名
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // v1头部最大长度，包含\r\n
+)
+
+// Command 代理命令
+type Command byte
+
+const (
+	CommandLocal Command = 0x0 // 代理自身发起的连接(如健康检查)，不携带客户端地址
+	CommandProxy Command = 0x1 // 代理转发的连接
+)
+
+// TLV v2头部扩展信息
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// 常用TLV类型
+const (
+	TLVTypeALPN      byte = 0x01
+	TLVTypeAuthority byte = 0x02
+	TLVTypeCRC32C    byte = 0x03
+	TLVTypeNoop      byte = 0x04
+	TLVTypeUniqueID  byte = 0x05
+	TLVTypeSSL       byte = 0x20
+	TLVTypeNetNS     byte = 0x30
+)
+
+// Header PROXY protocol头部
+type Header struct {
+	Version         int      // 协议版本，1或2
+	Command         Command  // 代理命令
+	Network         string   // 原始连接协议，tcp或udp，未知时为空
+	SourceAddr      net.Addr // 客户端地址，未知时为nil
+	DestinationAddr net.Addr // 代理接收连接的地址，未知时为nil
+	TLVs            []TLV    // v2扩展信息
+}
+
+// TLV 获取指定类型的扩展信息
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Read 从r中读取PROXY protocol头部
+// 数据不以PROXY头部开始时返回ErrNoHeader，此时不会消耗r中的数据
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, err := r.Peek(len(v1Prefix))
+		if err != nil {
+			return nil, err
+		}
+		if string(prefix) != v1Prefix {
+			return nil, ErrNoHeader
+		}
+		return complete(readV1(r))
+	case v2Signature[0]:
+		signature, err := r.Peek(len(v2Signature))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(signature, v2Signature) {
+			return nil, ErrNoHeader
+		}
+		return complete(readV2(r))
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// complete 读取头部过程中的读取错误转换为ErrIncompleteHeader
+func complete(header *Header, err error) (*Header, error) {
+	if err != nil && err != ErrInvalidHeader {
+		return nil, ErrIncompleteHeader
+	}
+	return header, err
+}
+
+// readV1 读取文本格式头部
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, ErrInvalidHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &Header{
+		Version: 1,
+		Command: CommandProxy,
+	}
+	if len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil || (fields[1] == "TCP4") != (srcIP.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+	srcPort, err := parsePort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dstPort, err := parsePort(fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	header.Network = "tcp"
+	header.SourceAddr = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	header.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return header, nil
+}
+
+// parsePort 解析端口
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, ErrInvalidHeader
+	}
+	return port, nil
+}
+
+// readV2 读取二进制格式头部
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	header := &Header{
+		Version: 2,
+		Command: Command(fixed[12] & 0x0F),
+	}
+	if header.Command != CommandLocal && header.Command != CommandProxy {
+		return nil, ErrInvalidHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	family := fixed[13] >> 4
+	transport := fixed[13] & 0x0F
+	switch transport {
+	case 0x1:
+		header.Network = "tcp"
+	case 0x2:
+		header.Network = "udp"
+	}
+
+	var addrLength int
+	switch family {
+	case 0x1: // AF_INET
+		addrLength = 12
+	case 0x2: // AF_INET6
+		addrLength = 36
+	case 0x3: // AF_UNIX
+		addrLength = 216
+	}
+	if len(payload) < addrLength {
+		return nil, ErrInvalidHeader
+	}
+
+	// LOCAL命令忽略地址
+	if header.Command == CommandProxy && header.Network != "" {
+		switch family {
+		case 0x1:
+			header.SourceAddr = newAddr(header.Network, net.IP(payload[0:4]), payload[8:10])
+			header.DestinationAddr = newAddr(header.Network, net.IP(payload[4:8]), payload[10:12])
+		case 0x2:
+			header.SourceAddr = newAddr(header.Network, net.IP(payload[0:16]), payload[32:34])
+			header.DestinationAddr = newAddr(header.Network, net.IP(payload[16:32]), payload[34:36])
+		}
+	}
+
+	tlvs, err := parseTLVs(payload[addrLength:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+	return header, nil
+}
+
+// newAddr 生成地址
+func newAddr(network string, ip net.IP, port []byte) net.Addr {
+	ip = append(net.IP(nil), ip...)
+	p := int(binary.BigEndian.Uint16(port))
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// parseTLVs 解析扩展信息
+func parseTLVs(data []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrInvalidHeader
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, ErrInvalidHeader
+		}
+		tlvs = append(tlvs, TLV{
+			Type:  data[0],
+			Value: append([]byte(nil), data[3:3+length]...),
+		})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// String 返回头部描述
+func (h *Header) String() string {
+	return fmt.Sprintf("PROXY v%d %s -> %s", h.Version, h.SourceAddr, h.DestinationAddr)
+}
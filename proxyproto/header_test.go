@@ -0,0 +1,96 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadV1(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"))
+	header, err := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 1 || header.SourceAddr.String() != "192.168.0.1:56324" || header.DestinationAddr.String() != "192.168.0.11:443" {
+		t.Fatalf("unexpected header %s", header)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "hello" {
+		t.Fatalf("expected remaining data hello, got %q", rest)
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	payload := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x1F, 0x90, 0x01, 0xBB}
+	payload = append(payload, TLVTypeAuthority, 0, 11)
+	payload = append(payload, "example.com"...)
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(v2Signature)
+	buf.WriteByte(0x21) // v2 PROXY
+	buf.WriteByte(0x11) // AF_INET STREAM
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(payload)
+	buf.WriteString("hello")
+
+	r := bufio.NewReader(buf)
+	header, err := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Network != "tcp" || header.SourceAddr.String() != "10.0.0.1:8080" || header.DestinationAddr.String() != "10.0.0.2:443" {
+		t.Fatalf("unexpected header %s", header)
+	}
+	if authority, ok := header.TLV(TLVTypeAuthority); !ok || string(authority) != "example.com" {
+		t.Fatalf("unexpected authority %q", authority)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "hello" {
+		t.Fatalf("expected remaining data hello, got %q", rest)
+	}
+}
+
+func TestReadNoHeader(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("PROTOCOL\r\n"))
+	if _, err := Read(r); err != ErrNoHeader {
+		t.Fatalf("expected no header error, got %v", err)
+	}
+	if r.Buffered() != 10 {
+		t.Fatal("data consumed without header")
+	}
+}
+
+func TestTrustedSources(t *testing.T) {
+	trusted, err := parseSources([]string{"10.0.0.0/8", "192.168.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isTrusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, trusted) {
+		t.Fatal("expected trusted source")
+	}
+	if !isTrusted(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}, trusted) {
+		t.Fatal("expected trusted ip source")
+	}
+	if isTrusted(&net.TCPAddr{IP: net.ParseIP("192.168.0.2"), Port: 80}, trusted) {
+		t.Fatal("expected untrusted source")
+	}
+
+	// 可信来源不能为空或非法
+	if err := (&Config{}).Validate(); err != ErrNoTrustedSources {
+		t.Fatalf("expected no trusted sources error, got %v", err)
+	}
+	if err := (&Config{TrustedSources: []string{"10.0.0.0/33"}}).Validate(); err == nil {
+		t.Fatal("expected invalid source error")
+	}
+}
+
+func TestReadIncompleteHeader(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("PROXY TCP4 203.0.113.7"))
+	if _, err := Read(r); err != ErrIncompleteHeader {
+		t.Fatalf("expected incomplete header error, got %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package goserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zboyco/go-server/filter"
+)
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	rate   float64   // 每秒生成令牌数
+	burst  float64   // 桶容量
+	tokens float64   // 当前令牌数
+	last   time.Time // 上次更新时间
+}
+
+// newTokenBucket 新建令牌桶，初始为满
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// refill 按时间补充令牌
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// allow 尝试获取一个令牌
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	return false
+}
+
+// wait 返回获取一个令牌需要等待的时间，不消耗令牌
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take 消耗一个令牌，令牌不足时预支，预支部分由等待时间补足
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// full 令牌桶是否已满，满的桶可以回收
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// bucketSet 按key区分的令牌桶集合，定期回收已满的桶
+type bucketSet struct {
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+	cleaned time.Time
+	sync.Mutex
+}
+
+// newBucketSet 新建令牌桶集合
+func newBucketSet(rate float64, burst int) *bucketSet {
+	return &bucketSet{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		cleaned: time.Now(),
+	}
+}
+
+// bucket 获取key对应的令牌桶，需持有锁
+func (s *bucketSet) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(s.cleaned) > time.Minute {
+		for k, b := range s.buckets {
+			if b.full(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.cleaned = now
+	}
+	b, exist := s.buckets[key]
+	if !exist {
+		b = newTokenBucket(s.rate, s.burst, now)
+		s.buckets[key] = b
+	}
+	return b
+}
+
+// allow 尝试获取key对应的令牌
+func (s *bucketSet) allow(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	return s.bucket(key, now).allow(now)
+}
+
+// RateLimit 限流参数
+type RateLimit struct {
+	Rate  float64 // 每秒允许的消息数
+	Burst int     // 允许突发的消息数，默认为Rate且不小于1
+}
+
+// RateLimitKey 限流维度
+type RateLimitKey int
+
+const (
+	RateLimitBySession RateLimitKey = iota // 按会话限流
+	RateLimitByIP                          // 按客户端IP限流
+	RateLimitByAttr                        // 按会话属性限流
+)
+
+// RateLimitAction 超过限制时的处理方式
+type RateLimitAction int
+
+const (
+	RateLimitDrop  RateLimitAction = iota // 丢弃消息
+	RateLimitReply                        // 回复错误信息后丢弃消息
+	RateLimitDelay                        // 延迟到有令牌时处理
+	RateLimitClose                        // 关闭会话
+)
+
+// RateLimiterConfig 消息限流配置
+type RateLimiterConfig struct {
+	RateLimit                                           // 默认限制，Rate<=0时不限制
+	Key        RateLimitKey                             // 限流维度
+	Attr       string                                   // 按会话属性限流时的属性名，属性不存在时按会话限流
+	KeyFunc    func(session *AppSession) string         // 自定义限流维度，设置后忽略Key
+	Routes     map[string]RateLimit                     // 按action路径单独限制，与默认限制同时生效，优先于路由选项中的限制
+	Action     RateLimitAction                          // 超过限制时的处理方式
+	Reply      []byte                                   // RateLimitReply时回复的内容
+	MaxDelay   time.Duration                            // RateLimitDelay时最长等待时间，超过则丢弃，默认1s；每个会话同时只有一条消息等待
+	OnViolated func(session *AppSession, action string) // 超过限制通知
+}
+
+// RateLimiter 消息限流器
+// 可以作为中间件使用，也可以通过Server.SetRateLimiter在调用action前检查
+type RateLimiter struct {
+	config  RateLimiterConfig
+	buckets *bucketSet            // 默认限制
+	routes  map[string]*bucketSet // 按action路径的限制
+	options sync.Map              // 按路由选项的限制，action路径对应*bucketSet
+}
+
+// NewRateLimiter 新建消息限流器
+func NewRateLimiter(config RateLimiterConfig) *RateLimiter {
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = time.Second
+	}
+	l := &RateLimiter{
+		config: config,
+		routes: make(map[string]*bucketSet),
+	}
+	if config.Rate > 0 {
+		l.buckets = newBucketSet(config.Rate, config.Burst)
+	}
+	for path, limit := range config.Routes {
+		if limit.Rate > 0 {
+			l.routes[strings.ToLower(path)] = newBucketSet(limit.Rate, limit.Burst)
+		}
+	}
+	return l
+}
+
+// Middleware 返回限流中间件，建议作为第一个before中间件
+func (l *RateLimiter) Middleware() ActionFunc {
+	return l.check
+}
+
+// key 返回会话的限流维度
+func (l *RateLimiter) key(session *AppSession) string {
+	if l.config.KeyFunc != nil {
+		return l.config.KeyFunc(session)
+	}
+	switch l.config.Key {
+	case RateLimitByIP:
+		if ip := filter.AddrIP(session.RemoteAddr()); ip != nil {
+			return ip.String()
+		}
+	case RateLimitByAttr:
+		if value, err := session.GetAttr(l.config.Attr); err == nil {
+			return fmt.Sprint(value)
+		}
+	}
+	return session.ID
+}
+
+// reserve 同时检查默认限制及action限制，均允许时才从两者获取令牌
+// 需要等待的时间不超过maxDelay时也视为允许，返回需要等待的时间及是否允许
+func (l *RateLimiter) reserve(key, action string, options *RouteOptions, maxDelay time.Duration) (time.Duration, bool) {
+	sets := make([]*bucketSet, 0, 2)
+	if l.buckets != nil {
+		sets = append(sets, l.buckets)
+	}
+	if buckets := l.routeBuckets(action, options); buckets != nil {
+		sets = append(sets, buckets)
+	}
+
+	// 固定按默认限制、action限制的顺序加锁
+	now := time.Now()
+	buckets := make([]*tokenBucket, len(sets))
+	var wait time.Duration
+	for i, set := range sets {
+		set.Lock()
+		defer set.Unlock()
+		buckets[i] = set.bucket(key, now)
+		if bucketWait := buckets[i].wait(now); bucketWait > wait {
+			wait = bucketWait
+		}
+	}
+	if wait > maxDelay {
+		return wait, false
+	}
+	for _, bucket := range buckets {
+		bucket.take()
+	}
+	return wait, true
+}
+
+// routeBuckets 返回action的限制，配置中未设置时使用路由选项中的限制
+func (l *RateLimiter) routeBuckets(action string, options *RouteOptions) *bucketSet {
+	if buckets, exist := l.routes[action]; exist {
+		return buckets
+	}
+	if options == nil || options.RateLimit == nil || options.RateLimit.Rate <= 0 {
+		return nil
+	}
+	if buckets, exist := l.options.Load(action); exist {
+		return buckets.(*bucketSet)
+	}
+	buckets, _ := l.options.LoadOrStore(action, newBucketSet(options.RateLimit.Rate, options.RateLimit.Burst))
+	return buckets.(*bucketSet)
+}
+
+// check 检查会话当前消息是否超过限制
+func (l *RateLimiter) check(session *AppSession, token []byte) ([]byte, error) {
+	action := session.CurrentAction()
+	var maxDelay time.Duration
+	// 每个会话同时只有一条消息等待，其余超过限制的消息按丢弃处理
+	if l.config.Action == RateLimitDelay && session.rateDelaying.CompareAndSwap(false, true) {
+		defer session.rateDelaying.Store(false)
+		maxDelay = l.config.MaxDelay
+	}
+	// 仅允许的消息消耗令牌，被拒绝的消息不会累积欠账
+	if wait, ok := l.reserve(l.key(session), action, session.RouteOptions(), maxDelay); ok {
+		if wait > 0 {
+			session.rateLimitWait(wait)
+		}
+		return token, nil
+	}
+
+	if l.config.OnViolated != nil {
+		l.config.OnViolated(session, action)
+	}
+	switch l.config.Action {
+	case RateLimitReply:
+		if len(l.config.Reply) > 0 {
+			_ = session.Send(l.config.Reply)
+		}
+	case RateLimitClose:
+		go session.close(newCloseReason(CloseRejected, ErrRateLimited))
+	}
+	return nil, ErrRateLimited
+}
+
+// SetRateLimiter 设置消息限流器，在调用中间件及action前检查
+func (server *Server) SetRateLimiter(limiter *RateLimiter) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.rateLimiter = limiter
+	return nil
+}
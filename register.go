@@ -0,0 +1,227 @@
+package goserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	goodbyeTimeout      = time.Second // 发送拒绝数据的超时时间
+	udpPendingDatagrams = 32          // udp会话注册期间最多缓存的数据报数量
+)
+
+// RegisterConfig 会话注册配置
+type RegisterConfig struct {
+	Register      func(ctx context.Context, session *AppSession) error // 注册方法，返回错误时拒绝会话，会话在返回后才加入会话池，可以在其中设置会话属性；超时后ctx被取消
+	Timeout       time.Duration                                        // 注册方法超时时间，超时视为拒绝，默认5s，<0不限制
+	Goodbye       func(session *AppSession, err error) []byte          // 拒绝会话时发送给客户端的数据，经过发送数据过滤器，返回nil时不发送
+	RejectBackoff time.Duration                                        // udp被拒绝的地址在该时间内发送的数据直接丢弃，默认10s，<0不限制
+}
+
+// sessionRegistrar 会话注册器
+type sessionRegistrar struct {
+	config   RegisterConfig
+	pending  sync.Map    // udp正在注册的会话ID对应的*pendingDatagrams
+	rejected rejectCache // udp被拒绝的地址
+}
+
+// SetSessionRegister 设置会话注册方法，在会话加入会话池及新会话通知前调用
+// udp会话在单独的协程中注册，注册期间收到的数据报缓存后在注册成功时处理
+func (server *Server) SetSessionRegister(config RegisterConfig) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if config.Register == nil {
+		server.register = nil
+		return nil
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.RejectBackoff == 0 {
+		config.RejectBackoff = 10 * time.Second
+	}
+	server.register = &sessionRegistrar{
+		config:   config,
+		rejected: rejectCache{items: make(map[string]time.Time), cleaned: time.Now()},
+	}
+	return nil
+}
+
+// registerSession 调用会话注册方法，被拒绝的会话已关闭且不会触发关闭通知
+func (server *Server) registerSession(session *AppSession) bool {
+	if server.register == nil {
+		return true
+	}
+	err := server.callRegister(session)
+	if err == nil {
+		return true
+	}
+
+	config := server.register.config
+	session.log().Info("session rejected", "error", err.Error())
+	server.metrics.ConnectionRejected(session.network, "register")
+	if session.network == UDP && config.RejectBackoff > 0 {
+		server.register.rejected.add(session.getUDPAddr().String(), time.Now().Add(config.RejectBackoff))
+	}
+	if config.Goodbye != nil {
+		if goodbye := config.Goodbye(session, err); goodbye != nil {
+			if err := server.sendGoodbye(session, goodbye); err != nil {
+				session.log().Debug("send goodbye error", "error", err.Error())
+			}
+		}
+	}
+	session.reject(newCloseReason(CloseRejected, err))
+	if session.releaseConnection != nil {
+		session.releaseConnection()
+	}
+	return false
+}
+
+// callRegister 在超时时间内调用注册方法，超时后取消注册方法的ctx
+func (server *Server) callRegister(session *AppSession) error {
+	config := server.register.config
+	if config.Timeout < 0 {
+		return config.Register(context.Background(), session)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- config.Register(ctx, session)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ErrRegisterTimeout
+	}
+}
+
+// sendGoodbye 在超时时间内发送拒绝数据，避免客户端不读取时阻塞
+func (server *Server) sendGoodbye(session *AppSession, goodbye []byte) error {
+	if err := session.setWriteDeadline(time.Now().Add(goodbyeTimeout)); err != nil {
+		return err
+	}
+	defer session.setWriteDeadline(time.Time{})
+	return session.sendGoodbye(goodbye)
+}
+
+// udpRegistering 判断地址是否正在注册或近期被拒绝，是则缓存或丢弃数据报
+func (server *Server) udpRegistering(sessionID string, clientAddr *net.UDPAddr, data []byte) bool {
+	if server.register == nil {
+		return false
+	}
+	if pending, ok := server.register.pending.Load(sessionID); ok && pending.(*pendingDatagrams).push(clientAddr.String(), data) {
+		return true
+	}
+	if server.register.rejected.contains(clientAddr.String(), time.Now()) {
+		server.metrics.ConnectionRejected(UDP, "register")
+		return true
+	}
+	return false
+}
+
+// registerUDPSession 在单独的协程中注册udp会话，避免阻塞接收数据
+// 注册成功后依次处理注册期间收到的数据报
+func (server *Server) registerUDPSession(session *AppSession, data []byte) {
+	pending := &pendingDatagrams{addr: session.getUDPAddr().String(), datagrams: [][]byte{data}}
+	server.register.pending.Store(session.ID, pending)
+
+	server.handlers.Add(1)
+	go func() {
+		defer server.handlers.Done()
+		ok := server.registerSession(session)
+		if ok {
+			server.openUDPSession(session)
+		}
+
+		// 处理缓存的数据报，处理完毕前新数据报继续加入缓存，保证顺序
+		for {
+			datagrams := pending.take(!ok)
+			if datagrams == nil {
+				break
+			}
+			for _, datagram := range datagrams {
+				server.udpInput(session, datagram)
+			}
+		}
+		server.register.pending.CompareAndDelete(session.ID, pending)
+	}()
+}
+
+// pendingDatagrams udp会话注册期间收到的数据报
+type pendingDatagrams struct {
+	addr      string // 注册中的会话地址
+	datagrams [][]byte
+	done      bool
+	sync.Mutex
+}
+
+// push 缓存数据报，注册已完成时返回false，超过数量或来自其他地址时丢弃
+func (p *pendingDatagrams) push(addr string, data []byte) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.done {
+		return false
+	}
+	if addr == p.addr && len(p.datagrams) < udpPendingDatagrams {
+		p.datagrams = append(p.datagrams, data)
+	}
+	return true
+}
+
+// take 取出缓存的数据报，缓存为空或discard时标记完成并返回nil
+func (p *pendingDatagrams) take(discard bool) [][]byte {
+	p.Lock()
+	defer p.Unlock()
+	datagrams := p.datagrams
+	p.datagrams = nil
+	if discard || len(datagrams) == 0 {
+		p.done = true
+		return nil
+	}
+	return datagrams
+}
+
+// rejectCache 近期被拒绝的地址，定期清理过期记录
+type rejectCache struct {
+	items   map[string]time.Time // 地址对应的过期时间
+	cleaned time.Time
+	sync.Mutex
+}
+
+// add 记录被拒绝的地址
+func (c *rejectCache) add(key string, until time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if now.Sub(c.cleaned) > time.Minute {
+		for k, expire := range c.items {
+			if now.After(expire) {
+				delete(c.items, k)
+			}
+		}
+		c.cleaned = now
+	}
+	c.items[key] = until
+}
+
+// contains 判断地址是否在拒绝期内
+func (c *rejectCache) contains(key string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	expire, exist := c.items[key]
+	if !exist {
+		return false
+	}
+	if now.After(expire) {
+		delete(c.items, key)
+		return false
+	}
+	return true
+}
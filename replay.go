@@ -0,0 +1,270 @@
+package goserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zboyco/go-server/capture"
+)
+
+// SetCapture 设置流量录制，记录所有会话的建立、关闭及收发的数据
+// writer为nil时不录制，writer需由调用方在服务停止后关闭
+func (server *Server) SetCapture(writer *capture.Writer) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.capture = writer
+	return nil
+}
+
+// ReplayConfig 回放参数
+type ReplayConfig struct {
+	Timeout time.Duration // 等待每条消息回复的最长时间，默认1s
+}
+
+// ReplayMismatch 回放结果与录制不一致的消息
+type ReplayMismatch struct {
+	SessionID string // 录制时的会话ID
+	Index     int    // 会话内消息序号，0为会话建立时，大于消息数表示回放结束后多出的数据
+	Action    string // 录制时的action路径
+	Input     []byte // 回放的原始数据
+	Expected  []byte // 录制时发送的数据
+	Actual    []byte // 回放时发送的数据
+}
+
+// ReplayResult 回放结果
+type ReplayResult struct {
+	Sessions   int              // 回放的会话数
+	Frames     int              // 回放的消息数
+	Mismatches []ReplayMismatch // 不一致的消息
+}
+
+// OK 回放结果是否与录制一致
+func (result *ReplayResult) OK() bool {
+	return len(result.Mismatches) == 0
+}
+
+// replayStep 回放步骤，写入一条消息并等待对应的回复
+type replayStep struct {
+	action   string
+	input    []byte
+	expected []byte
+}
+
+// replaySession 按会话分组的回放步骤
+type replaySession struct {
+	id    string
+	steps []*replayStep
+}
+
+// Replay 读取录制文件，按会话逐个通过内存连接回放，并与录制时发送的数据比较
+// 回放按tcp流处理，不经过连接过滤器、封禁检查及tls握手，会话中升级tls后的数据按明文回放
+// 每条消息写入后等待收到与录制时等长的数据或超时，录制时未回复的消息不等待
+// 回放使用独立的会话池，不触发会话注册、通知、事件、指标、限流及录制，服务运行时返回ErrServerRunning
+func (server *Server) Replay(r io.Reader, config ReplayConfig) (*ReplayResult, error) {
+	if server.running.Load() {
+		return nil, ErrServerRunning
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+	if len(server.actions) == 0 {
+		return nil, errors.New("no message action")
+	}
+
+	records, err := capture.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read capture error")
+	}
+
+	replayer := server.replayServer()
+	result := &ReplayResult{}
+	for _, rs := range groupReplaySessions(records) {
+		result.Sessions++
+		result.Frames += len(rs.steps) - 1
+		result.Mismatches = append(result.Mismatches, replayer.replaySession(rs, config)...)
+	}
+	return result, nil
+}
+
+// replayServer 新建用于回放的服务，仅复制消息处理相关的设置
+func (server *Server) replayServer() *Server {
+	replayer := newServer(TCP, "", 0, server.tlsConfig)
+	replayer.replaying = true
+	replayer.tlsHandshakeTimeout = server.tlsHandshakeTimeout
+	replayer.tlsVerifier = server.tlsVerifier
+	replayer.IdleSessionTimeOut = server.IdleSessionTimeOut
+	replayer.ioEOF = server.ioEOF
+	replayer.splitFunc = server.splitFunc
+	replayer.resolveAction = server.resolveAction
+	replayer.maxScanTokenSize = server.maxScanTokenSize
+	replayer.middlewaresBefore = server.middlewaresBefore
+	replayer.middlewaresAfter = server.middlewaresAfter
+	replayer.sendPacketFilter = server.sendPacketFilter
+	replayer.actions = server.actions
+	replayer.logger = server.logger
+	if server.auth != nil {
+		// 保留认证流程，不启动认证超时检测
+		auth := *server.auth
+		auth.config.Timeout = -1
+		replayer.auth = &auth
+	}
+	replayer.prepare()
+	return replayer
+}
+
+// groupReplaySessions 按会话首次出现的顺序分组
+func groupReplaySessions(records []capture.Record) []*replaySession {
+	var sessions []*replaySession
+	index := make(map[string]*replaySession)
+	for _, record := range records {
+		rs, exist := index[record.SessionID]
+		if !exist {
+			rs = &replaySession{id: record.SessionID, steps: []*replayStep{{}}}
+			index[record.SessionID] = rs
+			sessions = append(sessions, rs)
+		}
+		switch record.Direction {
+		case capture.Inbound:
+			rs.steps = append(rs.steps, &replayStep{action: record.Action, input: record.Payload})
+		case capture.Outbound:
+			step := rs.steps[len(rs.steps)-1]
+			step.expected = append(step.expected, record.Payload...)
+		}
+	}
+	return sessions
+}
+
+// replaySession 回放单个会话
+func (server *Server) replaySession(rs *replaySession, config ReplayConfig) []ReplayMismatch {
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.serveTCPSession(serverConn, nil, nil, nil)
+	}()
+
+	output := newReplayOutput(clientConn)
+
+	var mismatches []ReplayMismatch
+	for i, step := range rs.steps {
+		if len(step.input) > 0 {
+			_ = clientConn.SetWriteDeadline(time.Now().Add(config.Timeout))
+			if _, err := clientConn.Write(step.input); err != nil {
+				mismatches = append(mismatches, ReplayMismatch{
+					SessionID: rs.id,
+					Index:     i,
+					Action:    step.action,
+					Input:     step.input,
+					Expected:  step.expected,
+				})
+				break
+			}
+		}
+		actual := output.take(len(step.expected), config.Timeout)
+		if !bytes.Equal(actual, step.expected) {
+			mismatches = append(mismatches, ReplayMismatch{
+				SessionID: rs.id,
+				Index:     i,
+				Action:    step.action,
+				Input:     step.input,
+				Expected:  step.expected,
+				Actual:    actual,
+			})
+		}
+	}
+
+	_ = clientConn.Close()
+	<-done
+	output.wait()
+
+	if rest := output.take(-1, 0); len(rest) > 0 {
+		mismatches = append(mismatches, ReplayMismatch{
+			SessionID: rs.id,
+			Index:     len(rs.steps),
+			Actual:    rest,
+		})
+	}
+	return mismatches
+}
+
+// replayOutput 持续读取回放连接上服务端发送的数据
+type replayOutput struct {
+	buf    []byte
+	notify chan struct{}
+	done   chan struct{}
+	sync.Mutex
+}
+
+// newReplayOutput 新建并开始读取
+func newReplayOutput(conn net.Conn) *replayOutput {
+	output := &replayOutput{
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(output.done)
+		buf := make([]byte, 4*1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				output.Lock()
+				output.buf = append(output.buf, buf[:n]...)
+				output.Unlock()
+				select {
+				case output.notify <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return output
+}
+
+// take 等待读取n字节数据，超时返回已读取的数据，n<0时返回全部数据
+func (output *replayOutput) take(n int, timeout time.Duration) []byte {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		output.Lock()
+		if n < 0 {
+			n = len(output.buf)
+		}
+		if len(output.buf) >= n {
+			data := output.buf[:n:n]
+			output.buf = output.buf[n:]
+			output.Unlock()
+			return data
+		}
+		output.Unlock()
+
+		select {
+		case <-output.notify:
+		case <-output.done:
+			output.Lock()
+			data := output.buf
+			output.buf = nil
+			output.Unlock()
+			return data
+		case <-timer.C:
+			output.Lock()
+			data := output.buf
+			output.buf = nil
+			output.Unlock()
+			return data
+		}
+	}
+}
+
+// wait 等待读取结束
+func (output *replayOutput) wait() {
+	<-output.done
+}
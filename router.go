@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type ActionFunc func(*AppSession, []byte) ([]byte, error)
@@ -17,9 +18,28 @@ type ActionSummary interface {
 	Summary() string // 返回当前模块描述
 }
 
+// ActionRouteOptions 模块可选接口，为方法设置路由选项
+type ActionRouteOptions interface {
+	RouteOptions() map[string]RouteOptions // 返回方法名对应的路由选项
+}
+
+// RouteOptions 路由选项，可在中间件中通过session.RouteOptions()获取
+type RouteOptions struct {
+	Description string     // 路由描述
+	RequireAuth bool       // 是否需要认证，配合Authorize中间件使用
+	Roles       []string   // 需要的角色(任一)，配合Authorize中间件使用
+	RateLimit   *RateLimit // 单独的消息频率限制，配合RateLimiter使用
+}
+
+// route 路由
+type route struct {
+	actions []ActionFunc
+	options *RouteOptions
+}
+
 // RegisterModule 注册方法处理模块（命令路由）
 func (server *Server) RegisterModule(m ActionModule) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -50,6 +70,11 @@ func (server *Server) RegisterModule(m ActionModule) error {
 		afterAction = middlewaresAfterAction.MiddlewaresAfterAction()
 	}
 
+	var routeOptions map[string]RouteOptions
+	if actionRouteOptions, ok := m.(ActionRouteOptions); ok {
+		routeOptions = actionRouteOptions.RouteOptions()
+	}
+
 	for i := 0; i < mType.NumMethod(); i++ {
 		tem := mValue.Method(i).Interface()
 		if temFunc, ok := tem.(func(*AppSession, []byte) ([]byte, error)); ok {
@@ -63,7 +88,11 @@ func (server *Server) RegisterModule(m ActionModule) error {
 			if afterAction != nil {
 				actions = append(actions, afterAction...)
 			}
-			err := server.action(callPath, structPath, method.Name, actions...)
+			var options *RouteOptions
+			if option, exist := routeOptions[method.Name]; exist {
+				options = &option
+			}
+			err := server.action(callPath, structPath, method.Name, options, actions...)
 			if err != nil {
 				return fmt.Errorf("%s => %s", callPath, err.Error())
 			}
@@ -73,64 +102,112 @@ func (server *Server) RegisterModule(m ActionModule) error {
 }
 
 // hookAction 调用action
-func (server *Server) hookAction(funcName string, session *AppSession, token []byte) error {
+// span为当前消息的追踪span，中间件、action及发送在其子span中执行
+func (server *Server) hookAction(span Span, funcName string, session *AppSession, token []byte) (err error) {
 	funcName = strings.ToLower(funcName)
-	actions, exist := server.actions[funcName]
+	span.SetAttr(AttrAction, funcName)
+	route, exist := server.actions[funcName]
 	if !exist {
-		return ErrActionNotFound
+		return server.actionError(PhaseResolve, session, funcName, ErrActionNotFound)
+	}
+	actions := route.actions
+
+	// 路由信息按执行协程记录，记录最近执行的action用于统计
+	leave := session.enterRoute(funcName, route.options)
+	defer leave()
+	session.currentAction.Store(funcName)
+	defer session.currentAction.CompareAndSwap(funcName, "")
+
+	if server.rateLimiter != nil {
+		if token, err = server.rateLimiter.check(session, token); err != nil {
+			return server.actionError(PhaseMiddleware, session, funcName, err)
+		}
 	}
-	var err error
+
+	// 记录action耗时
+	start := time.Now()
+	defer func() {
+		server.metrics.ActionHandled(funcName, time.Since(start), err)
+	}()
 	if server.middlewaresBefore != nil {
 		for i := range server.middlewaresBefore {
-			token, err = server.middlewaresBefore[i](session, token)
+			token, err = server.traceCall(span, SpanBeforeMiddleware, i, server.middlewaresBefore[i], session, token)
 			if err != nil {
-				return err
+				return server.actionError(PhaseMiddleware, session, funcName, err)
 			}
 		}
 	}
 	for i := range actions {
-		token, err = actions[i](session, token)
+		token, err = server.traceCall(span, SpanAction, i, actions[i], session, token)
 		if err != nil {
-			return err
+			return server.actionError(PhaseAction, session, funcName, err)
 		}
 	}
 	if server.middlewaresAfter != nil {
 		for i := range server.middlewaresAfter {
-			token, err = server.middlewaresAfter[i](session, token)
+			token, err = server.traceCall(span, SpanAfterMiddleware, i, server.middlewaresAfter[i], session, token)
 			if err != nil {
-				return err
+				return server.actionError(PhaseMiddleware, session, funcName, err)
 			}
 		}
 	}
 	if token != nil {
-		return session.Send(token)
+		sendSpan := server.tracer.StartSpan(span, SpanSend, SpanAttr{AttrSize, len(token)})
+		err = session.Send(token)
+		sendSpan.End(err)
+		if err != nil {
+			return server.actionError(PhaseSend, session, funcName, err)
+		}
 	}
 	return nil
 }
 
+// actionError 生成执行action过程中的错误
+func (server *Server) actionError(phase ErrorPhase, session *AppSession, action string, err error) *Error {
+	e := newError(phase, session, err, "")
+	e.Action = action
+	return e
+}
+
 // Action 添加单个Action
 func (server *Server) Action(path string, actionFunc ...ActionFunc) error {
-	if server.running {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	return server.action(path, ".", "", nil, actionFunc...)
+}
+
+// ActionWithOptions 添加带路由选项的单个Action
+func (server *Server) ActionWithOptions(path string, options RouteOptions, actionFunc ...ActionFunc) error {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
-	return server.action(path, ".", "", actionFunc...)
+	return server.action(path, ".", "", &options, actionFunc...)
 }
 
-func (server *Server) action(path, structPath, methodName string, actionFunc ...ActionFunc) error {
+func (server *Server) action(path, structPath, methodName string, options *RouteOptions, actionFunc ...ActionFunc) error {
 	if path == "" || path[0] != '/' {
 		return ErrPathFormat
 	}
 	if _, exist := server.actions[path]; exist {
 		return ErrActionConflict
 	}
-	server.actions[path] = actionFunc
+	server.actions[path] = &route{
+		actions: actionFunc,
+		options: options,
+	}
 
 	// 生成路由
+	description := ""
+	if options != nil {
+		description = options.Description
+	}
 	if _, exist := server.routers[structPath]; !exist {
 		server.routers[structPath] = make([][]string, 0)
 	}
-	server.routers[structPath] = append(server.routers[structPath], []string{path, methodName})
+	server.routers[structPath] = append(server.routers[structPath], []string{path, methodName, description})
 	return nil
 }
 
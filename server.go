@@ -4,11 +4,21 @@ import (
 	"bufio"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/zboyco/go-server/arq"
+	"github.com/zboyco/go-server/capture"
 	"github.com/zboyco/go-server/filter"
+	"github.com/zboyco/go-server/fragment"
+	"github.com/zboyco/go-server/proxyproto"
 )
 
 type Network string
@@ -18,21 +28,50 @@ const (
 	UDP Network = "udp"
 )
 
+// UDPMode UDP数据处理模式
+type UDPMode int
+
+const (
+	UDPModeStream   UDPMode = iota // 流模式(默认)，数据报写入会话缓冲区后按拆包规则拆分
+	UDPModeDatagram                // 数据报模式，每个数据报即为一个完整消息，不经过拆包规则
+	UDPModeReliable                // 可靠模式，在UDP之上提供有序可靠的字节流，按拆包规则拆分
+)
+
+// ConnectionIDFunc 从udp数据报中提取连接ID
+// 返回连接ID及去除连接ID后的数据，连接ID将作为会话ID使用
+type ConnectionIDFunc func(datagram []byte) (connID string, payload []byte, err error)
+
+// MigrationVerifier 校验udp会话地址迁移，payload为新地址发来的数据(已去除连接ID)
+// 返回错误时拒绝迁移并丢弃该数据报，可用于校验与连接ID绑定的令牌或签名
+type MigrationVerifier func(session *AppSession, newAddr *net.UDPAddr, payload []byte) error
+
+// TLSVerifier tls握手完成后校验连接状态，返回错误时拒绝会话
+type TLSVerifier func(state *tls.ConnectionState) error
+
 // Server 服务结构
 type Server struct {
-	network                    Network       // 传输协议
-	ip                         string        // 服务器IP
-	port                       int           // 服务器端口
-	sessionSource              *sessionPool  // Session池
-	idleSessionTimeOutDuration time.Duration // 超时持续时间，用于设置deadline
-	tlsConfig                  *tls.Config   // tls配置
+	network                    Network            // 传输协议
+	ip                         string             // 服务器IP
+	port                       int                // 服务器端口
+	sessionSource              *sessionPool       // Session池
+	idleSessionTimeOutDuration time.Duration      // 超时持续时间，用于设置deadline
+	tlsConfig                  *tls.Config        // tls配置
+	tlsHandshakeTimeout        time.Duration      // tls握手超时时间
+	tlsVerifier                TLSVerifier        // tls握手后的校验方法
+	certManager                *CertManager       // 证书管理器
+	certWatchInterval          time.Duration      // 证书文件检查间隔
+	proxyProtocol              *proxyproto.Config // PROXY protocol配置，为nil时不解析
 
 	AcceptCount        int // 用于接收连接请求的协程数量
 	IdleSessionTimeOut int // 客户端空闲超时时间(秒)，默认300s,<=0则不设置超时
 
-	onError              func(error)               // 错误方法
-	onNewSessionRegister func(*AppSession)         // 新客户端接入
-	onSessionClosed      func(*AppSession, string) // 客户端关闭通知
+	onError                   func(error)                                              // 错误方法
+	onErrorWithContext        func(*Error)                                             // 错误方法，附带错误阶段及会话
+	onNewSessionRegister      func(*AppSession)                                        // 新客户端接入
+	onSessionClosed           func(*AppSession, string)                                // 客户端关闭通知
+	onSessionClosedWithReason func(*AppSession, *CloseReason)                          // 客户端关闭通知，附带关闭原因
+	onSessionMigrated         func(session *AppSession, oldAddr, newAddr *net.UDPAddr) // udp会话地址迁移通知
+	onConnectionRejected      func(addr net.Addr, reason RejectReason)                 // 连接因限制被拒绝通知
 
 	ioEOF               []byte                                                        // IO结束标记
 	connectionFilterTCP []filter.ConnectionFilterTCP                                  // TCP连接过滤器
@@ -43,25 +82,61 @@ type Server struct {
 	middlewaresBefore   Middlewares                                                   // action执行前中间件
 	middlewaresAfter    Middlewares                                                   // action执行后中间件
 	sendPacketFilter    Middlewares                                                   // 发送数据过滤
-	actions             map[string][]ActionFunc                                       // 消息处理方法字典
-
-	running bool                  // 是否正在运行
-	routers map[string][][]string // 用于启动时输出路由表
+	actions             map[string]*route                                             // 消息处理方法字典
+	connectionLimiter   *connectionLimiter                                            // 连接限制器
+	rateLimiter         *RateLimiter                                                  // 消息限流器
+	banList             *banList                                                      // IP封禁名单
+	auth                *authenticator                                                // 认证器
+	metrics             MetricsRecorder                                               // 指标记录器
+	tracer              Tracer                                                        // 链路追踪
+	capture             *capture.Writer                                               // 流量录制
+	events              *eventBus                                                     // 事件总线
+	register            *sessionRegistrar                                             // 会话注册器
+	logger              *slog.Logger                                                  // 日志，为nil时使用slog默认日志
+	bannerWriter        io.Writer                                                     // 启动信息输出，为nil时不输出
+
+	udpMode           UDPMode            // UDP数据处理模式
+	udpOrdered        bool               // 数据报模式下是否按会话顺序投递
+	udpWorkers        int                // 数据报模式并发处理的最大协程数量
+	udpWorkerSlots    chan struct{}      // 数据报模式并发处理的协程名额，启动时创建
+	arqConfig         *arq.Config        // 可靠模式传输参数
+	arqHandshaker     *arq.Handshaker    // 可靠模式握手器，启动时创建
+	fragmentConfig    *fragment.Config   // 分片参数，为nil时不分片
+	fragmentSplitter  *fragment.Splitter // 发送分片器
+	fragmentGroup     *fragment.Group    // 重组器组，限制所有会话未完成重组的消息总量
+	udpReadBufferSize int                // udp读取缓冲区大小
+	udpConnectionID   ConnectionIDFunc   // udp连接ID提取方法
+	udpMigration      MigrationVerifier  // udp会话地址迁移校验方法
+	multicastGroups   []*multicastGroup  // 加入的组播组
+	udpConn           atomic.Value       // udp服务socket(*net.UDPConn)
+
+	running       atomic.Bool           // 是否正在运行
+	handlers      sync.WaitGroup        // 正在处理的tcp连接及注册中的udp会话，停止时等待结束
+	stopping      atomic.Bool           // 是否正在停止
+	replaying     bool                  // 是否为回放服务，回放时不升级tls
+	closeListener atomic.Value          // 关闭监听的方法(func())
+	routers       map[string][][]string // 用于启动时输出路由表
 }
 
 func newServer(network Network, ip string, port int, config *tls.Config) *Server {
 	return &Server{
-		network: network,
-		ip:      ip,
-		port:    port,
-		sessionSource: &sessionPool{
-			list: make(chan *sessionHandle, 100),
-		},
-		IdleSessionTimeOut: 300,
-		AcceptCount:        1,
-		actions:            make(map[string][]ActionFunc),
-		splitFunc:          bufio.ScanLines,
-		tlsConfig:          config,
+		network:             network,
+		ip:                  ip,
+		port:                port,
+		sessionSource:       &sessionPool{},
+		IdleSessionTimeOut:  300,
+		AcceptCount:         1,
+		udpReadBufferSize:   4 * 1024,
+		udpWorkers:          256,
+		actions:             make(map[string]*route),
+		banList:             newBanList(),
+		events:              newEventBus(),
+		metrics:             nopMetricsRecorder{},
+		tracer:              nopTracer{},
+		bannerWriter:        os.Stdout,
+		splitFunc:           bufio.ScanLines,
+		tlsConfig:           config,
+		tlsHandshakeTimeout: 10 * time.Second,
 
 		routers: make(map[string][][]string),
 	}
@@ -69,32 +144,25 @@ func newServer(network Network, ip string, port int, config *tls.Config) *Server
 
 // Start 开始监听
 func (server *Server) Start() {
-	if server.running {
-		slog.Error("server is running")
+	if !server.running.CompareAndSwap(false, true) {
+		server.log().Error("server is running")
 		return
 	}
-	server.running = true
-	defer func() {
-		server.running = false
-	}()
-
-	if server.splitFunc == nil {
-		slog.Info("use default split function")
-		server.splitFunc = bufio.ScanLines
-	}
+	server.stopping.Store(false)
+	defer server.running.Store(false)
 
 	if len(server.actions) == 0 {
-		slog.Error("no message action")
+		server.log().Error("no message action")
 		return
 	}
 
-	server.idleSessionTimeOutDuration = time.Duration(server.IdleSessionTimeOut) * time.Second
+	server.prepare()
 
 	addr := fmt.Sprintf("%s:%d", server.ip, server.port)
 	if server.ip != "" && server.ip != "localhost" {
 		ipAddr := net.ParseIP(server.ip)
 		if ipAddr == nil {
-			slog.Error(fmt.Sprintf("ip address [%s] error", server.ip))
+			server.log().Error("ip address error", "ip", server.ip)
 			return
 		}
 		if ipAddr.To4() == nil {
@@ -108,59 +176,380 @@ func (server *Server) Start() {
 	case UDP:
 		server.startUDP(addr)
 	default:
-		slog.Error(fmt.Sprintf("unknown network %s", server.network))
+		server.log().Error("unknown network", AttrNetwork, string(server.network))
 		return
 	}
 }
 
+// Stop 停止服务，关闭监听及所有会话，所有会话关闭后Start返回
+// 会话关闭原因类型为CloseServerShutdown
+func (server *Server) Stop() error {
+	closeListener, _ := server.closeListener.Load().(func())
+	if !server.running.Load() || closeListener == nil {
+		return ErrServerNotRunning
+	}
+	if !server.stopping.CompareAndSwap(false, true) {
+		return nil
+	}
+	server.log().Info("server stopping")
+	server.events.publish(&Event{Type: EventServerStopping})
+	closeListener()
+	return nil
+}
+
+// closeAllSessions 服务停止时关闭所有会话
+func (server *Server) closeAllSessions() {
+	reason := &CloseReason{Kind: CloseServerShutdown, Text: "server shutdown"}
+	// 并行关闭，可靠模式会话关闭时需等待未确认数据
+	var wg sync.WaitGroup
+	for session := range server.GetAllSessions() {
+		wg.Add(1)
+		go func(session *AppSession) {
+			defer wg.Done()
+			session.close(reason)
+		}(session)
+	}
+	wg.Wait()
+}
+
+// closeIfStopping 服务停止后才加入会话池的会话立即关闭
+// 会话在加入会话池后检查，与closeAllSessions配合保证停止时不遗留会话
+func (server *Server) closeIfStopping(session *AppSession) {
+	if server.stopping.Load() {
+		session.close(&CloseReason{Kind: CloseServerShutdown, Text: "server shutdown"})
+	}
+}
+
+// prepare 初始化处理会话所需的默认参数
+func (server *Server) prepare() {
+	if server.splitFunc == nil {
+		server.log().Info("use default split function")
+		server.splitFunc = bufio.ScanLines
+	}
+
+	server.idleSessionTimeOutDuration = time.Duration(server.IdleSessionTimeOut) * time.Second
+}
+
 func (server *Server) printServerInfo() {
+	w := server.bannerWriter
+	if w == nil {
+		return
+	}
 	for k, v := range server.routers {
-		fmt.Printf("[GO-SERVER] Source %s\n", k)
+		fmt.Fprintf(w, "[GO-SERVER] Source %s\n", k)
 		for _, action := range v {
-			fmt.Printf("[GO-SERVER]        %s", action[0])
+			fmt.Fprintf(w, "[GO-SERVER]        %s", action[0])
 			if action[1] != "" {
-				fmt.Printf("   ==>   %s", action[1])
+				fmt.Fprintf(w, "   ==>   %s", action[1])
+			}
+			if action[2] != "" {
+				fmt.Fprintf(w, "   (%s)", action[2])
+			}
+			fmt.Fprint(w, "\n")
+		}
+	}
+	fmt.Fprintf(w, "[GO-SERVER] Listen %s on %s:%d\n\n", server.network, server.ip, server.port)
+}
+
+// log 获取日志
+func (server *Server) log() *slog.Logger {
+	if server.logger != nil {
+		return server.logger
+	}
+	return slog.Default()
+}
+
+// sessionLogger 生成会话日志，附带会话ID及传输协议
+func (server *Server) sessionLogger(sessionID string) *slog.Logger {
+	return server.log().With(AttrSessionID, sessionID, AttrNetwork, string(server.network))
+}
+
+// scanState scanner拆包状态，在下次Scan前有效
+type scanState struct {
+	remain  []byte // 尚未拆包的数据
+	frame   []byte // 当前token拆包时消耗的原始数据，仅在开启流量录制时记录
+	skipped []byte // 拆包函数跳过的数据，计入下一个token的原始数据
+}
+
+// newScanner 创建按拆包规则读取的scanner
+// state不为nil时记录拆包状态
+func (server *Server) newScanner(r io.Reader, state *scanState) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if server.maxScanTokenSize > 0 {
+		if server.maxScanTokenSize > 4*1024 {
+			scanner.Buffer(make([]byte, 0, 4*1024), server.maxScanTokenSize)
+		} else {
+			scanner.Buffer(make([]byte, 0, server.maxScanTokenSize), server.maxScanTokenSize)
+		}
+	}
+
+	// 设置分离函数，拆包错误标记为协议错误
+	splitFunc := server.splitFunc
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := splitFunc(data, atEOF)
+		if state != nil && (err == nil || err == bufio.ErrFinalToken) && advance >= 0 && advance <= len(data) {
+			state.remain = data[advance:]
+			if server.capture != nil {
+				if token != nil {
+					state.frame = append(state.skipped, data[:advance]...)
+					state.skipped = nil
+				} else if advance > 0 {
+					state.skipped = append(state.skipped, data[:advance]...)
+				}
+			}
+		}
+		if err != nil && err != bufio.ErrFinalToken {
+			err = &protocolError{err}
+		}
+		return advance, token, err
+	})
+	return scanner
+}
+
+// serveStream 以流方式读取会话数据并处理，读取结束后关闭会话
+// 用于tcp及可靠udp会话，conn的读超时用于闲置检测
+func (server *Server) serveStream(session *AppSession, conn net.Conn) {
+	// 创建scanner
+	state := &scanState{}
+	scanner := server.newScanner(server.meteredReader(session, conn), state)
+
+	// 设置闲置超时时间
+	if server.IdleSessionTimeOut > 0 {
+		err := conn.SetReadDeadline(time.Now().Add(server.idleSessionTimeOutDuration))
+		if err != nil {
+			server.handleOnError(newError(PhaseSplit, session, err, "set read deadline error"))
+			return
+		}
+	}
+
+	var err error
+	// 获取数据
+	for scanner.Scan() {
+		// 设置闲置超时时间
+		if server.IdleSessionTimeOut > 0 {
+			err = conn.SetReadDeadline(time.Now().Add(server.idleSessionTimeOutDuration))
+			if err != nil {
+				break
+			}
+		}
+		err = server.handleToken(session, state.frame, scanner.Bytes())
+		if err != nil {
+			break
+		}
+
+		// action中调用了StartTLS，升级连接后重新创建scanner，已读取未处理的数据交给tls连接
+		// 录制的数据为明文，回放时不升级
+		if config := session.takePendingTLS(); config != nil && !server.replaying {
+			conn, err = server.upgradeTLS(session, conn, config, state.remain)
+			if err != nil {
+				err = newError(PhaseAccept, session, err, "")
+				break
+			}
+			if server.IdleSessionTimeOut > 0 {
+				if err = conn.SetReadDeadline(time.Now().Add(server.idleSessionTimeOutDuration)); err != nil {
+					break
+				}
 			}
-			fmt.Print("\n")
+			scanner = server.newScanner(server.meteredReader(session, conn), state)
+		}
+	}
+
+	// 错误处理
+	if err == nil {
+		if err = scanner.Err(); err != nil {
+			session.errorCount.Add(1)
+		}
+	}
+	if err != nil {
+		server.handleOnError(wrapError(PhaseSplit, session, err, fmt.Sprintf("scan %s error", session.network)))
+		if isProtocolError(err) {
+			server.recordViolation(session)
+		}
+		server.closeSession(session, readCloseReason(err))
+		return
+	}
+	server.closeSession(session, newCloseReason(CloseEOF, io.EOF))
+}
+
+// meteredReader 统计tcp会话读取的字节数，udp在接收数据报时统计
+func (server *Server) meteredReader(session *AppSession, r io.Reader) io.Reader {
+	if session.network != TCP {
+		return r
+	}
+	return &meteredReader{r: r, session: session, metrics: server.metrics}
+}
+
+// handleToken 解析token并调用对应action
+// 仅返回解析错误，action执行错误交由handleOnError处理
+// raw为拆包时消耗的原始数据，用于流量录制
+func (server *Server) handleToken(session *AppSession, raw, token []byte) (err error) {
+	server.metrics.FrameReceived(session.network)
+	session.framesIn.Add(1)
+
+	// 开始追踪
+	span := server.tracer.StartSpan(nil, SpanMessage,
+		SpanAttr{AttrSessionID, session.ID},
+		SpanAttr{AttrNetwork, string(session.network)},
+		SpanAttr{AttrSize, len(token)},
+	)
+	var hookErr error
+	defer func() {
+		if err != nil {
+			session.errorCount.Add(1)
+			span.End(err)
+			return
+		}
+		if hookErr != nil {
+			session.errorCount.Add(1)
 		}
+		span.End(hookErr)
+	}()
+
+	// 未设置认证action时，认证阶段除无需认证的action外的数据直接交给认证方法
+	if server.auth != nil && server.auth.action == "" && session.Identity() == nil && !server.isPublicAction(token) {
+		session.capture(capture.Inbound, "", raw)
+		server.events.publishMessage(EventMessageReceived, session, "", token)
+		authSpan := server.tracer.StartSpan(span, SpanAuthenticate)
+		_, err = server.authenticate(session, "", token)
+		authSpan.End(err)
+		if err != nil {
+			return newError(PhaseAuth, session, err, "")
+		}
+		return nil
+	}
+
+	actionName := ""
+	if server.resolveAction != nil {
+		resolveSpan := server.tracer.StartSpan(span, SpanResolve)
+		actionName, token, err = server.resolveAction(token)
+		resolveSpan.SetAttr(AttrAction, actionName)
+		resolveSpan.End(err)
+		if err != nil {
+			session.capture(capture.Inbound, "", raw)
+			server.events.publishMessage(EventMessageReceived, session, "", token)
+			return newError(PhaseResolve, session, &protocolError{err}, "")
+		}
+	}
+	session.capture(capture.Inbound, strings.ToLower(actionName), raw)
+	server.events.publishMessage(EventMessageReceived, session, strings.ToLower(actionName), token)
+
+	// 认证阶段
+	if server.auth != nil && session.Identity() == nil {
+		authSpan := server.tracer.StartSpan(span, SpanAuthenticate, SpanAttr{AttrAction, actionName})
+		handled, authErr := server.authenticate(session, actionName, token)
+		authSpan.End(authErr)
+		if authErr != nil {
+			authError := newError(PhaseAuth, session, authErr, "")
+			authError.Action = strings.ToLower(actionName)
+			return authError
+		}
+		if handled {
+			return nil
+		}
+	}
+	if hookErr = server.hookAction(span, actionName, session, token); hookErr != nil {
+		// 超过限流的消息已按配置处理，不作为错误
+		if errors.Is(hookErr, ErrRateLimited) {
+			session.log().Debug("message dropped", AttrAction, actionName, "error", hookErr.Error())
+			server.recordViolation(session)
+			return nil
+		}
+		server.handleOnError(wrapError(PhaseAction, session, hookErr, ""))
 	}
-	fmt.Printf("[GO-SERVER] Listen %s on %s:%d\n\n", server.network, server.ip, server.port)
+	return nil
+}
+
+// protocolError 协议错误，由拆包或解析请求方法产生，计入自动封禁违规次数
+type protocolError struct {
+	err error
 }
 
-func (server *Server) handleOnError(err error) {
-	slog.Error(err.Error())
+func (e *protocolError) Error() string {
+	return e.err.Error()
+}
+
+func (e *protocolError) Unwrap() error {
+	return e.err
+}
+
+// isProtocolError 判断是否为协议错误
+func isProtocolError(err error) bool {
+	var protocolErr *protocolError
+	return errors.As(err, &protocolErr) || errors.Is(err, bufio.ErrTooLong)
+}
+
+// handleOnError 记录错误并通知错误处理方法
+func (server *Server) handleOnError(err *Error) {
+	logger := server.log()
+	if err.Session != nil {
+		logger = err.Session.log()
+	} else if err.RemoteAddr != nil {
+		logger = logger.With(AttrRemoteAddr, err.RemoteAddr.String())
+	}
+	if err.Phase != 0 {
+		logger = logger.With("phase", err.Phase.String())
+	}
+	if err.Action != "" && (err.Session == nil || err.Session.CurrentAction() == "") {
+		logger = logger.With(AttrAction, err.Action)
+	}
+	logger.Error(err.Error())
+
+	server.metrics.ErrorOccurred()
 	if server.onError != nil {
 		server.onError(err)
 	}
+	if server.onErrorWithContext != nil {
+		server.onErrorWithContext(err)
+	}
+	if server.events.subscribed(EventError) {
+		server.events.publish(&Event{Type: EventError, Session: err.Session, Action: err.Action, Err: err})
+	}
 }
 
 // closeSession 关闭session
-func (server *Server) closeSession(session *AppSession, reason string) {
-	go session.Close(reason)
+func (server *Server) closeSession(session *AppSession, reason *CloseReason) {
+	go session.close(reason)
 }
 
 // closeSessionTrigger 关闭session触发器
-func (server *Server) closeSessionTrigger(session *AppSession) func(string) {
-	return func(reason string) {
+func (server *Server) closeSessionTrigger(session *AppSession) func(*CloseReason) {
+	return func(reason *CloseReason) {
+		// 先从池中移除，同ID的新会话(如重新连接的udp客户端)不会再查找到已关闭的会话
+		server.sessionSource.deleteSession(session)
+
 		// 如果设置了ioEOF，尝试发送
 		if len(server.ioEOF) != 0 {
 			_ = session.Send(server.ioEOF)
 		}
 
+		// 释放连接限制名额
+		if session.releaseConnection != nil {
+			session.releaseConnection()
+		}
+
+		// 停止认证超时检测
+		if session.authTimer != nil {
+			session.authTimer.Stop()
+		}
+
+		server.metrics.SessionClosed(session.network)
+		session.capture(capture.Close, "", []byte(reason.Text))
+
 		// 关闭session通知
 		if server.onSessionClosed != nil {
-			go server.onSessionClosed(session, reason)
+			go server.onSessionClosed(session, reason.Text)
 		}
-
-		// 从池中移除
-		go server.sessionSource.deleteSession(session)
+		if server.onSessionClosedWithReason != nil {
+			go server.onSessionClosedWithReason(session, reason)
+		}
+		server.events.publish(&Event{Type: EventSessionClosed, Session: session, Reason: reason})
 	}
 }
 
 // SetEOF 设置IO结束标记
 // 设置后，服务器关闭客户端时，会尝试发送此标记
 func (server *Server) SetEOF(ioEOF []byte) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -170,7 +559,7 @@ func (server *Server) SetEOF(ioEOF []byte) error {
 
 // SetSplitFunc 设置数据拆包方法
 func (server *Server) SetSplitFunc(splitFunc bufio.SplitFunc) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -180,7 +569,7 @@ func (server *Server) SetSplitFunc(splitFunc bufio.SplitFunc) error {
 
 // SetReceiveFilter 设置过滤器
 func (server *Server) SetReceiveFilter(s filter.ReceiveFilter) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -191,7 +580,7 @@ func (server *Server) SetReceiveFilter(s filter.ReceiveFilter) error {
 
 // SetMaxScanTokenSize 设置数据最大长度
 func (server *Server) SetMaxScanTokenSize(maxScanTokenSize int) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -199,19 +588,177 @@ func (server *Server) SetMaxScanTokenSize(maxScanTokenSize int) error {
 	return nil
 }
 
+// SetUDPMode 设置UDP数据处理模式
+// 数据报模式下每个数据报直接交给resolveAction和action处理，不再使用拆包规则
+func (server *Server) SetUDPMode(mode UDPMode) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.udpMode = mode
+	return nil
+}
+
+// SetUDPOrderedDelivery 设置数据报模式下是否按会话顺序投递
+// 开启后同一会话的数据报按接收顺序依次处理，否则并发处理
+// 每个会话最多排队256个数据报，超出时丢弃并计入会话统计的DatagramsDropped
+func (server *Server) SetUDPOrderedDelivery(ordered bool) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.udpOrdered = ordered
+	return nil
+}
+
+// SetUDPDatagramWorkers 设置数据报模式并发处理的最大协程数量，默认256
+// 未开启按会话顺序投递时生效，达到上限后暂停接收数据，<=0时使用默认值
+func (server *Server) SetUDPDatagramWorkers(workers int) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if workers <= 0 {
+		workers = 256
+	}
+	server.udpWorkers = workers
+	return nil
+}
+
+// SetUDPReliableConfig 设置可靠模式传输参数
+// 为nil时使用默认参数，仅在UDPModeReliable模式下生效
+func (server *Server) SetUDPReliableConfig(config *arq.Config) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.arqConfig = config
+	return nil
+}
+
+// SetUDPFragmentation 设置UDP分片
+// 开启后发送的数据按分片发送，接收的分片按会话重组后再处理，未分片的数据报按原样处理，为nil时关闭
+// 可靠模式下由传输层处理分段，此设置无效
+func (server *Server) SetUDPFragmentation(config *fragment.Config) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.fragmentConfig = config
+	server.fragmentSplitter = nil
+	server.fragmentGroup = nil
+	if config != nil {
+		server.fragmentSplitter = fragment.NewSplitter(config)
+		server.fragmentGroup = fragment.NewGroup(config)
+	}
+	return nil
+}
+
+// SetUDPReadBufferSize 设置udp读取缓冲区大小，默认4KiB
+// 超过缓冲区大小的数据报会被截断
+func (server *Server) SetUDPReadBufferSize(size int) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.udpReadBufferSize = size
+	return nil
+}
+
+// SetUDPConnectionID 设置udp连接ID提取方法
+// 设置后以数据报中携带的连接ID区分会话，客户端地址变化时会话保持不变
+func (server *Server) SetUDPConnectionID(connectionIDFunc ConnectionIDFunc) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.udpConnectionID = connectionIDFunc
+	return nil
+}
+
+// SetUDPMigrationVerifier 设置udp会话地址迁移校验方法
+// 连接ID可被伪造，未设置校验方法时拒绝迁移，同一连接ID来自其他地址的数据报会被丢弃
+func (server *Server) SetUDPMigrationVerifier(verifier MigrationVerifier) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.udpMigration = verifier
+	return nil
+}
+
+// SetProxyProtocol 设置解析PROXY protocol头部，仅tcp服务有效
+// 开启后连接过滤器及会话获取到的地址为头部中的客户端原始地址，为nil时关闭
+// 可信来源不能为空，仅可信来源的连接会读取头部
+func (server *Server) SetProxyProtocol(config *proxyproto.Config) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return errors.Wrap(err, "invalid proxy protocol config")
+		}
+	}
+
+	server.proxyProtocol = config
+	return nil
+}
+
+// SetTLSHandshakeTimeout 设置tls握手超时时间，默认10s，<=0则不设置超时
+func (server *Server) SetTLSHandshakeTimeout(timeout time.Duration) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.tlsHandshakeTimeout = timeout
+	return nil
+}
+
+// SetTLSVerifier 设置tls握手后的校验方法
+// 可根据客户端证书等信息拒绝会话，返回错误时关闭连接
+func (server *Server) SetTLSVerifier(verifier TLSVerifier) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.tlsVerifier = verifier
+	return nil
+}
+
+// SetLogger 设置日志，默认使用slog默认日志
+// 会话相关日志附带session_id、remote_addr、network及action等属性
+func (server *Server) SetLogger(logger *slog.Logger) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.logger = logger
+	return nil
+}
+
+// SetBannerWriter 设置启动时路由表及监听信息的输出，默认为标准输出，为nil时不输出
+func (server *Server) SetBannerWriter(w io.Writer) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.bannerWriter = w
+	return nil
+}
+
 // SetOnMessage 设置接收到新消息处理方法
 func (server *Server) SetOnMessage(onMessageFunc ActionFunc) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
-	server.actions[""] = []ActionFunc{onMessageFunc}
+	server.actions[""] = &route{actions: []ActionFunc{onMessageFunc}}
 	return nil
 }
 
 // SetOnError 设置接收到错误处理方法
 func (server *Server) SetOnError(onErrorFunc func(error)) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -219,9 +766,20 @@ func (server *Server) SetOnError(onErrorFunc func(error)) error {
 	return nil
 }
 
+// SetOnErrorWithContext 设置错误处理方法，可以获取错误发生的阶段、会话及action
+// 可以与SetOnError同时设置
+func (server *Server) SetOnErrorWithContext(onErrorFunc func(err *Error)) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.onErrorWithContext = onErrorFunc
+	return nil
+}
+
 // SetOnNewSessionRegister 设置新会话加入时处理方法
 func (server *Server) SetOnNewSessionRegister(onNewSessionRegisterFunc func(*AppSession)) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -231,7 +789,7 @@ func (server *Server) SetOnNewSessionRegister(onNewSessionRegisterFunc func(*App
 
 // SetOnSessionClosed 设置会话关闭时处理方法
 func (server *Server) SetOnSessionClosed(onSessionClosedFunc func(session *AppSession, reason string)) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -239,9 +797,31 @@ func (server *Server) SetOnSessionClosed(onSessionClosedFunc func(session *AppSe
 	return nil
 }
 
+// SetOnSessionClosedWithReason 设置会话关闭时处理方法，可以通过关闭原因类型区分超时、断开等情况
+// 可以与SetOnSessionClosed同时设置
+func (server *Server) SetOnSessionClosedWithReason(onSessionClosedFunc func(session *AppSession, reason *CloseReason)) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.onSessionClosedWithReason = onSessionClosedFunc
+	return nil
+}
+
+// SetOnSessionMigrated 设置udp会话地址迁移时处理方法
+// 仅在设置连接ID提取方法及迁移校验方法后生效
+func (server *Server) SetOnSessionMigrated(onSessionMigratedFunc func(session *AppSession, oldAddr, newAddr *net.UDPAddr)) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	server.onSessionMigrated = onSessionMigratedFunc
+	return nil
+}
+
 // RegisterConnectionFilterTCP 注册TCP连接过滤器
 func (server *Server) RegisterConnectionFilterTCP(connectionFilter ...filter.ConnectionFilterTCP) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -251,7 +831,7 @@ func (server *Server) RegisterConnectionFilterTCP(connectionFilter ...filter.Con
 
 // RegisterConnectionFilterUDP 注册UDP连接过滤器
 func (server *Server) RegisterConnectionFilterUDP(connectionFilter ...filter.ConnectionFilterUDP) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -261,7 +841,7 @@ func (server *Server) RegisterConnectionFilterUDP(connectionFilter ...filter.Con
 
 // RegisterSendPacketFilter 注册发送数据包过滤器
 func (server *Server) RegisterSendPacketFilter(mids Middlewares) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -271,7 +851,7 @@ func (server *Server) RegisterSendPacketFilter(mids Middlewares) error {
 
 // RegisterBeforeMiddlewares 注册action前置中间件
 func (server *Server) RegisterBeforeMiddlewares(mids Middlewares) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -281,7 +861,7 @@ func (server *Server) RegisterBeforeMiddlewares(mids Middlewares) error {
 
 // RegisterAfterMiddlewares 注册action后置中间件
 func (server *Server) RegisterAfterMiddlewares(mids Middlewares) error {
-	if server.running {
+	if server.running.Load() {
 		return ErrServerRunning
 	}
 
@@ -0,0 +1,103 @@
+package goserver
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// multicastGroup 组播组
+type multicastGroup struct {
+	ip         net.IP   // 组播地址
+	ifaceNames []string // 加入组播的网卡名称，为空时由系统选择
+}
+
+// JoinMulticastGroup 加入组播组，仅udp服务有效
+// 监听端口为服务端口，ifaceNames为空时由系统选择网卡，多个组播组需为同一地址族
+// 设置后服务使用组播socket监听，同时接收单播、组播及广播数据，发送方作为会话处理
+func (server *Server) JoinMulticastGroup(group string, ifaceNames ...string) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() {
+		return ErrMulticastAddress
+	}
+	// 所有组播组在同一socket上加入，需为同一地址族
+	if len(server.multicastGroups) > 0 && (server.multicastGroups[0].ip.To4() == nil) != (ip.To4() == nil) {
+		return ErrMulticastAddress
+	}
+	for _, name := range ifaceNames {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return errors.Wrapf(err, "interface [%s] error", name)
+		}
+	}
+
+	server.multicastGroups = append(server.multicastGroups, &multicastGroup{
+		ip:         ip,
+		ifaceNames: ifaceNames,
+	})
+	return nil
+}
+
+// listenMulticast 使用一个socket监听服务端口并加入所有组播组
+// 第一个组播组由ListenMulticastUDP监听，其余组播组及网卡在同一socket上加入，单播、组播及广播数据均由该socket接收
+func (server *Server) listenMulticast(port int) (*net.UDPConn, error) {
+	type membership struct {
+		ip    net.IP
+		iface *net.Interface
+	}
+	var memberships []membership
+	for _, group := range server.multicastGroups {
+		if len(group.ifaceNames) == 0 {
+			memberships = append(memberships, membership{ip: group.ip})
+			continue
+		}
+		for _, name := range group.ifaceNames {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "interface [%s] error", name)
+			}
+			memberships = append(memberships, membership{ip: group.ip, iface: iface})
+		}
+	}
+
+	first := memberships[0]
+	conn, err := net.ListenMulticastUDP("udp", first.iface, &net.UDPAddr{IP: first.ip, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range memberships[1:] {
+		if err := joinMulticastGroup(conn, m.iface, m.ip); err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrapf(err, "join multicast group [%s] error", m.ip)
+		}
+	}
+	return conn, nil
+}
+
+// SendMulticast 向组播组发送原始数据，不经过发送数据包过滤器
+// 服务加入组播组时使用组播socket发送，该socket关闭了本机回环，本机监听者无法收到
+func (server *Server) SendMulticast(group string, port int, data []byte) error {
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() {
+		return ErrMulticastAddress
+	}
+	return server.sendUDPTo(&net.UDPAddr{IP: ip, Port: port}, data)
+}
+
+// SendBroadcast 向本地网络广播原始数据，不经过发送数据包过滤器
+func (server *Server) SendBroadcast(port int, data []byte) error {
+	return server.sendUDPTo(&net.UDPAddr{IP: net.IPv4bcast, Port: port}, data)
+}
+
+// sendUDPTo 使用服务socket发送数据
+func (server *Server) sendUDPTo(addr *net.UDPAddr, data []byte) error {
+	udpConn, _ := server.udpConn.Load().(*net.UDPConn)
+	if udpConn == nil {
+		return ErrServerNotRunning
+	}
+	_, err := udpConn.WriteToUDP(data, addr)
+	return err
+}
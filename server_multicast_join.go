@@ -0,0 +1,62 @@
+//go:build unix || windows
+
+package goserver
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// joinMulticastGroup 在已监听的socket上加入组播组
+func joinMulticastGroup(conn *net.UDPConn, iface *net.Interface, ip net.IP) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var joinErr error
+	if ip4 := ip.To4(); ip4 != nil {
+		mreq := &syscall.IPMreq{}
+		copy(mreq.Multiaddr[:], ip4)
+		if iface != nil {
+			addr, err := interfaceIPv4(iface)
+			if err != nil {
+				return err
+			}
+			copy(mreq.Interface[:], addr)
+		}
+		err = raw.Control(func(fd uintptr) {
+			joinErr = setsockoptIPMreq(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+		})
+	} else {
+		mreq := &syscall.IPv6Mreq{}
+		copy(mreq.Multiaddr[:], ip)
+		if iface != nil {
+			mreq.Interface = uint32(iface.Index)
+		}
+		err = raw.Control(func(fd uintptr) {
+			joinErr = setsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return joinErr
+}
+
+// interfaceIPv4 获取网卡的ipv4地址，用于指定加入ipv4组播组的网卡
+func interfaceIPv4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				return ip4, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("interface [%s] has no ipv4 address", iface.Name)
+}
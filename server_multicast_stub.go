@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package goserver
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// joinMulticastGroup 当前平台不支持在同一socket上加入多个组播组
+func joinMulticastGroup(conn *net.UDPConn, iface *net.Interface, ip net.IP) error {
+	return errors.New("join multiple multicast groups is not supported on this platform")
+}
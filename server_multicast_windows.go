@@ -0,0 +1,15 @@
+//go:build windows
+
+package goserver
+
+import "syscall"
+
+// setsockoptIPMreq 设置ipv4组播选项
+func setsockoptIPMreq(fd uintptr, level, opt int, mreq *syscall.IPMreq) error {
+	return syscall.SetsockoptIPMreq(syscall.Handle(fd), level, opt, mreq)
+}
+
+// setsockoptIPv6Mreq 设置ipv6组播选项
+func setsockoptIPv6Mreq(fd uintptr, level, opt int, mreq *syscall.IPv6Mreq) error {
+	return syscall.SetsockoptIPv6Mreq(syscall.Handle(fd), level, opt, mreq)
+}
@@ -1,16 +1,16 @@
 package goserver
 
 import (
-	"bufio"
 	"crypto/tls"
 	"fmt"
-	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/zboyco/go-server/capture"
+	"github.com/zboyco/go-server/proxyproto"
 )
 
 // New 新建一个tcp服务
@@ -37,27 +37,23 @@ func NewTCPWithTLS(ip string, port int, config *tls.Config) *Server {
 
 // startTCP 开始监听
 func (server *Server) startTCP(addr string) {
-	var (
-		tcpListener net.Listener
-		err         error
-	)
-
 	// 监听端口
-	if server.tlsConfig == nil {
-		tcpListener, err = net.Listen("tcp", addr)
-	} else {
-		tcpListener, err = tls.Listen("tcp", addr, server.tlsConfig)
-	}
+	// tls在接收连接后建立，以便先读取PROXY头部
+	tcpListener, err := net.Listen("tcp", addr)
 	if err != nil {
-		server.handleOnError(errors.Wrap(err, "listen tcp error"))
+		server.handleOnError(newError(PhaseAccept, nil, err, "listen tcp error"))
 		return
 	}
 
 	// 程序返回后关闭socket
 	defer tcpListener.Close()
 
-	// 开启会话池管理
-	go server.sessionSource.sessionPoolManager()
+	server.closeListener.Store(func() { _ = tcpListener.Close() })
+	defer server.closeListener.Store((func())(nil))
+
+	// 检查证书文件修改
+	stopWatch := server.watchCertificates()
+	defer stopWatch()
 
 	var wg sync.WaitGroup
 	for i := 0; i < server.AcceptCount; i++ {
@@ -68,47 +64,125 @@ func (server *Server) startTCP(addr string) {
 				// 开始接收连接
 				conn, err := tcpListener.Accept()
 				if err != nil {
-					server.handleOnError(errors.Wrap(err, "accept tcp error"))
+					if server.stopping.Load() {
+						return
+					}
+					server.handleOnError(newError(PhaseAccept, nil, err, "accept tcp error"))
 					continue
 				}
-				// 启用goroutine处理
-				go server.handleTCPClient(conn)
+				// 启用goroutine处理，停止时等待处理结束
+				server.handlers.Add(1)
+				go func() {
+					defer server.handlers.Done()
+					server.handleTCPClient(conn)
+				}()
 			}
 		}(i)
 	}
 
 	server.printServerInfo()
+	server.events.publish(&Event{Type: EventServerStarted})
 
 	wg.Wait()
+	server.closeAllSessions()
+	server.handlers.Wait()
 }
 
 // handleTCPClient 读取数据
 func (server *Server) handleTCPClient(conn net.Conn) {
+	// 解析PROXY头部
+	var proxyHeader *proxyproto.Header
+	if server.proxyProtocol != nil {
+		proxyConn, err := proxyproto.NewConn(conn, server.proxyProtocol)
+		if err != nil {
+			server.handleOnError(newAddrError(PhaseAccept, conn.RemoteAddr(), err, fmt.Sprintf("read proxy protocol header from [%s] error", conn.RemoteAddr())))
+			_ = conn.Close()
+			return
+		}
+		conn = proxyConn
+		proxyHeader = proxyConn.Header()
+	}
+
+	// 拒绝已封禁IP
+	if server.isAddrBanned(conn.RemoteAddr()) {
+		server.log().Debug("connection refused because ip banned", AttrRemoteAddr, conn.RemoteAddr().String(), AttrNetwork, string(TCP))
+		server.metrics.ConnectionRejected(TCP, "banned")
+		_ = conn.Close()
+		return
+	}
+
 	// 连接过滤器
 	if server.connectionFilterTCP != nil {
 		for i := range server.connectionFilterTCP {
 			if err := server.connectionFilterTCP[i](conn); err != nil {
-				slog.Warn(fmt.Sprintf("connect[%s] filter because %s", conn.RemoteAddr(), err.Error()))
+				server.handleOnError(newAddrError(PhaseFilter, conn.RemoteAddr(), err, "connection filtered"))
+				server.metrics.ConnectionRejected(TCP, "filter")
 				_ = conn.Close()
 				return
 			}
 		}
 	}
 
+	// 连接限制
+	releaseConnection, ok := server.acquireConnection(conn.RemoteAddr())
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+
+	// 建立tls连接
+	var tlsState *tls.ConnectionState
+	if server.tlsConfig != nil {
+		tlsConn := tls.Server(conn, server.tlsConfig)
+		state, err := server.tlsHandshake(tlsConn)
+		if err != nil {
+			server.handleOnError(newAddrError(PhaseAccept, conn.RemoteAddr(), err, fmt.Sprintf("tls handshake with [%s] error", conn.RemoteAddr())))
+			server.metrics.ConnectionRejected(TCP, "tls")
+			if releaseConnection != nil {
+				releaseConnection()
+			}
+			_ = tlsConn.Close()
+			return
+		}
+		conn = tlsConn
+		tlsState = state
+	}
+
+	server.serveTCPSession(conn, proxyHeader, tlsState, releaseConnection)
+}
+
+// serveTCPSession 创建tcp会话并读取数据，直到会话关闭
+func (server *Server) serveTCPSession(conn net.Conn, proxyHeader *proxyproto.Header, tlsState *tls.ConnectionState, releaseConnection func()) {
 	// 创建会话对象
+	sessionID := uuid.NewString()
 	session := &AppSession{
-		ID:               uuid.NewString(),
+		ID:               sessionID,
 		network:          TCP,
 		conn:             conn,
 		attr:             make(map[string]interface{}),
 		sendPacketFilter: server.sendPacketFilter,
+		proxyHeader:      proxyHeader,
+		connectedAt:      time.Now(),
+		tlsState:         tlsState,
+		metrics:          server.metrics,
+		logger:           server.sessionLogger(sessionID),
+		captureWriter:    server.capture,
+		events:           server.events,
+
+		releaseConnection: releaseConnection,
 	}
 	// 设置会话关闭触发器
 	session.closeTrigger = server.closeSessionTrigger(session)
 
-	// 获取连接地址
-	remoteAddr := session.conn.RemoteAddr()
-	slog.Debug(fmt.Sprintf("client[%s] address: %s", session.ID, remoteAddr))
+	// 注册方法拒绝时关闭会话
+	if !server.registerSession(session) {
+		return
+	}
+
+	session.log().Debug("session connected")
+
+	// 开始认证超时检测
+	server.startAuthTimer(session)
 
 	// 新客户端接入通知
 	if server.onNewSessionRegister != nil {
@@ -117,61 +191,74 @@ func (server *Server) handleTCPClient(conn net.Conn) {
 
 	// 注册Session
 	server.sessionSource.addSession(session)
+	server.metrics.SessionOpened(TCP)
+	session.capture(capture.Open, "", []byte(conn.RemoteAddr().String()))
+	server.events.publish(&Event{Type: EventSessionOpened, Session: session})
+	server.closeIfStopping(session)
 
-	// 创建scanner
-	scanner := bufio.NewScanner(session.conn)
-	if server.maxScanTokenSize > 0 {
-		if server.maxScanTokenSize > 4*1024 {
-			scanner.Buffer(make([]byte, 0, 4*1024), server.maxScanTokenSize)
-		} else {
-			scanner.Buffer(make([]byte, 0, server.maxScanTokenSize), server.maxScanTokenSize)
-		}
-	}
-
-	// 设置分离函数
-	scanner.Split(server.splitFunc)
+	// 读取数据
+	server.serveStream(session, session.conn)
+}
 
-	// 设置闲置超时时间
-	if server.IdleSessionTimeOut > 0 {
-		err := session.conn.SetReadDeadline(time.Now().Add(server.idleSessionTimeOutDuration))
-		if err != nil {
-			server.handleOnError(errors.Wrap(err, "set read deadline error"))
-			return
+// tlsHandshake 在超时时间内完成tls握手并校验连接状态
+func (server *Server) tlsHandshake(conn *tls.Conn) (*tls.ConnectionState, error) {
+	if server.tlsHandshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(server.tlsHandshakeTimeout)); err != nil {
+			return nil, err
 		}
 	}
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
 
-	var err error
-	// 获取数据
-	for scanner.Scan() {
-		// 设置闲置超时时间
-		if server.IdleSessionTimeOut > 0 {
-			err = session.conn.SetReadDeadline(time.Now().Add(server.idleSessionTimeOutDuration))
-			if err != nil {
-				break
-			}
-		}
-		token := scanner.Bytes()
-		actionName := ""
-		if server.resolveAction != nil {
-			actionName, token, err = server.resolveAction(token)
-			if err != nil {
-				break
-			}
-		}
-		hookErr := server.hookAction(actionName, session, token)
-		if hookErr != nil {
-			server.handleOnError(hookErr)
+	state := conn.ConnectionState()
+	if server.tlsVerifier != nil {
+		if err := server.tlsVerifier(&state); err != nil {
+			return nil, errors.Wrap(err, "tls verify error")
 		}
 	}
+	return &state, nil
+}
 
-	// 错误处理
-	if err == nil {
-		err = scanner.Err()
+// upgradeTLS 将会话连接升级为tls，buffered为已读取但未处理的数据
+// 握手期间暂停发送，其他协程发送的数据在升级后通过tls发送，握手完成后才持有连接锁替换连接
+func (server *Server) upgradeTLS(session *AppSession, conn net.Conn, config *tls.Config, buffered []byte) (net.Conn, error) {
+	if len(buffered) > 0 {
+		conn = &bufferedConn{Conn: conn, buffer: append([]byte(nil), buffered...)}
 	}
+	tlsConn := tls.Server(conn, config)
+
+	session.upgradeLock.Lock()
+	defer session.upgradeLock.Unlock()
+	state, err := server.tlsHandshake(tlsConn)
 	if err != nil {
-		server.handleOnError(errors.Wrap(err, "scan tcp error"))
-		server.closeSession(session, err.Error())
-		return
+		return nil, errors.Wrap(err, "start tls error")
+	}
+
+	session.connLock.Lock()
+	session.conn = tlsConn
+	session.tlsState = state
+	session.connLock.Unlock()
+
+	session.log().Debug("session upgraded to tls")
+	return tlsConn, nil
+}
+
+// bufferedConn 优先读取缓存数据的连接
+type bufferedConn struct {
+	net.Conn
+	buffer []byte
+}
+
+// Read 缓存数据读取完后从连接读取
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if len(c.buffer) > 0 {
+		n := copy(p, c.buffer)
+		c.buffer = c.buffer[n:]
+		return n, nil
 	}
-	server.closeSession(session, "EOF")
+	return c.Conn.Read(p)
 }
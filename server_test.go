@@ -1,20 +1,41 @@
 package goserver_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	goserver "github.com/zboyco/go-server"
+	"github.com/zboyco/go-server/capture"
 	"github.com/zboyco/go-server/client"
 	"github.com/zboyco/go-server/filter"
+	"github.com/zboyco/go-server/fragment"
+	"github.com/zboyco/go-server/proxyproto"
 )
 
 type module struct{}
@@ -288,3 +309,2087 @@ func onError(err error) {
 	// 输出结果
 	log.Println("错误: ", err)
 }
+
+func TestUDPDatagramMode(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewUDP("", 8081)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetUDPOrderedDelivery(true)
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return token, nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	c := client.NewSimpleClient(goserver.UDP, "", 8081)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 每个数据报即为一个消息，不经过换行拆包
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("hello\nworld - %v", i)
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		result, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != msg {
+			t.Fatalf("expected %q, got %q", msg, result)
+		}
+	}
+}
+
+func TestUDPSessionReconnect(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewUDP("", 8109)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetUDPOrderedDelivery(true)
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			if string(token) == "bye" {
+				session.Close("bye")
+				return nil, nil
+			}
+			return token, nil
+		})
+		// 关闭通知较慢时，同一地址的新数据报不能交给已关闭的会话
+		mainServer.Subscribe(func(*goserver.Event) {
+			time.Sleep(300 * time.Millisecond)
+		}, goserver.SubscribeOptions{Types: []goserver.EventType{goserver.EventSessionClosed}})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	c := client.NewSimpleClient(goserver.UDP, "", 8109)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.GetRawConn().SetReadDeadline(time.Now().Add(3 * time.Second))
+	result, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "hello" {
+		t.Fatalf("expected hello, got %q", result)
+	}
+}
+
+func TestUDPReliableMode(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewUDP("", 8082)
+		_ = mainServer.SetUDPMode(goserver.UDPModeReliable)
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	c := client.NewSimpleClient(goserver.UDP, "", 8082)
+	c.SetReliableUDP(nil)
+	c.SetScannerSplitFunc(bufio.ScanLines)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 大于单个数据报的消息按流拆包
+	msg := strings.Repeat("hello reliable udp ", 1000)
+	if err := c.Send([]byte(msg + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.GetRawConn().SetReadDeadline(time.Now().Add(5 * time.Second))
+	result, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != msg {
+		t.Fatalf("expected %d bytes, got %d bytes", len(msg), len(result))
+	}
+}
+
+func TestUDPFragmentation(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewUDP("", 8083)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetUDPFragmentation(&fragment.Config{FragmentSize: 512})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return token, nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	c := client.NewSimpleClient(goserver.UDP, "", 8083)
+	c.SetUDPFragmentation(&fragment.Config{FragmentSize: 512})
+	c.SetBufferSize(64 * 1024)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 大于读取缓冲区的消息分片发送
+	msg := strings.Repeat("hello fragment ", 1000)
+	if err := c.Send([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.GetRawConn().SetReadDeadline(time.Now().Add(5 * time.Second))
+	result, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != msg {
+		t.Fatalf("expected %d bytes, got %d bytes", len(msg), len(result))
+	}
+
+	// 未分片的数据报按原样处理
+	raw, err := net.Dial("udp", "127.0.0.1:8083")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := fragment.NewConn(raw, &fragment.Config{FragmentSize: 512})
+	defer conn.Close()
+	_, _ = raw.Write([]byte("plain"))
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "plain" {
+		t.Fatalf("expected plain, got %q", buffer[:n])
+	}
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+func TestUDPConnectionID(t *testing.T) {
+	migrated := make(chan string, 1)
+	rejected := make(chan string, 1)
+	mainServer := goserver.NewUDP("", 8084)
+	go func() {
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		// 数据报格式为 连接ID|数据
+		_ = mainServer.SetUDPConnectionID(func(datagram []byte) (string, []byte, error) {
+			i := bytes.IndexByte(datagram, '|')
+			if i < 0 {
+				return "", nil, errors.New("missing connection id")
+			}
+			return string(datagram[:i]), datagram[i+1:], nil
+		})
+		// 数据为hello时允许迁移，实际使用时可校验与连接ID绑定的令牌
+		_ = mainServer.SetUDPMigrationVerifier(func(session *goserver.AppSession, newAddr *net.UDPAddr, payload []byte) error {
+			if string(payload) != "hello" {
+				return errInvalidToken
+			}
+			return nil
+		})
+		_ = mainServer.SetOnErrorWithContext(func(err *goserver.Error) {
+			if errors.Is(err, errInvalidToken) {
+				rejected <- err.RemoteAddr.String()
+			}
+		})
+		_ = mainServer.SetOnSessionMigrated(func(session *goserver.AppSession, oldAddr, newAddr *net.UDPAddr) {
+			migrated <- session.ID
+		})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return token, nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	// 两个socket模拟客户端地址变化
+	for i := 0; i < 2; i++ {
+		c := client.NewSimpleClient(goserver.UDP, "", 8084)
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			// 校验失败时拒绝迁移
+			if err := c.Send([]byte("conn-1|forged")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case addr := <-rejected:
+				if addr != c.GetRawConn().LocalAddr().String() {
+					t.Fatalf("expected rejected address %s, got %s", c.GetRawConn().LocalAddr(), addr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("forged migration not rejected")
+			}
+		}
+		if err := c.Send([]byte("conn-1|hello")); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.GetRawConn().SetReadDeadline(time.Now().Add(3 * time.Second))
+		result, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != "hello" {
+			t.Fatalf("expected hello, got %q", result)
+		}
+		_ = c.Close()
+	}
+
+	select {
+	case id := <-migrated:
+		if id != "conn-1" {
+			t.Fatalf("expected session conn-1, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not migrated")
+	}
+	if count := mainServer.CountSessions(); count != 1 {
+		t.Fatalf("expected 1 session, got %d", count)
+	}
+}
+
+func TestUDPMulticast(t *testing.T) {
+	mainServer := goserver.NewUDP("", 8085)
+	go func() {
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		for _, group := range []string{"239.1.2.3", "239.1.2.5"} {
+			if err := mainServer.JoinMulticastGroup(group); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := mainServer.JoinMulticastGroup("ff02::1:3"); err != goserver.ErrMulticastAddress {
+			t.Errorf("expected mixed address family rejected, got %v", err)
+		}
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append([]byte("reply "), token...), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	// 组播发现，服务器单播回复发送方，所有组播组及单播数据由同一socket接收
+	buf := make([]byte, 1024)
+	for _, ip := range []string{"239.1.2.3", "239.1.2.5", "127.0.0.1"} {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.WriteToUDP([]byte("discover"), &net.UDPAddr{IP: net.ParseIP(ip), Port: 8085}); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if string(buf[:n]) != "reply discover" {
+			t.Fatalf("%s: expected reply discover, got %q", ip, buf[:n])
+		}
+	}
+
+	// 服务器发送组播通告
+	// 组播socket关闭了本机回环，使用单播服务发送以便本机接收
+	announceServer := goserver.NewUDP("", 8087)
+	go func() {
+		_ = announceServer.SetOnMessage(onMessage)
+		announceServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	listener, err := net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("239.1.2.4"), Port: 8086})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := announceServer.SendMulticast("239.1.2.4", 8086, []byte("announce")); err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := listener.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "announce" {
+		t.Fatalf("expected announce, got %q", buf[:n])
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	filtered := make(chan string, 1)
+	go func() {
+		mainServer := goserver.NewTCP("", 8088)
+		_ = mainServer.SetProxyProtocol(&proxyproto.Config{
+			TrustedSources: []string{"127.0.0.0/8", "::1"},
+			Required:       true,
+		})
+		_ = mainServer.RegisterConnectionFilterTCP(func(conn net.Conn) error {
+			filtered <- conn.RemoteAddr().String()
+			return nil
+		})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return []byte(session.RemoteAddr().String() + "\n"), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8088")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 8088\r\nhello\n"))
+
+	if addr := <-filtered; addr != "203.0.113.7:40000" {
+		t.Fatalf("expected filter to see 203.0.113.7:40000, got %s", addr)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	result, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "203.0.113.7:40000\n" {
+		t.Fatalf("expected session address 203.0.113.7:40000, got %q", result)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	rejected := make(chan goserver.RejectReason, 10)
+	mainServer := goserver.NewTCP("", 8089)
+	go func() {
+		_ = mainServer.SetConnectionLimit(goserver.ConnectionLimit{
+			MaxSessionsPerIP: 2,
+		})
+		_ = mainServer.SetOnConnectionRejected(func(addr net.Addr, reason goserver.RejectReason) {
+			rejected <- reason
+		})
+		_ = mainServer.SetOnMessage(onMessage)
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:8089")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	select {
+	case reason := <-rejected:
+		if reason != goserver.RejectMaxSessionsPerIP {
+			t.Fatalf("expected %s, got %s", goserver.RejectMaxSessionsPerIP, reason)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not rejected")
+	}
+	if count := mainServer.RejectedConnections()[goserver.RejectMaxSessionsPerIP]; count != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", count)
+	}
+
+	// 关闭会话后释放名额
+	_ = conns[0].Close()
+	time.Sleep(500 * time.Millisecond)
+	conn, err := net.Dial("tcp", "127.0.0.1:8089")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns = append(conns, conn)
+	select {
+	case reason := <-rejected:
+		t.Fatalf("unexpected rejection %s", reason)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewTCP("", 8090)
+		_ = mainServer.SetRateLimiter(goserver.NewRateLimiter(goserver.RateLimiterConfig{
+			RateLimit: goserver.RateLimit{Rate: 1, Burst: 2},
+			Action:    goserver.RateLimitReply,
+			Reply:     []byte("limited\n"),
+		}))
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("1\n2\n" + strings.Repeat("3\n", 20)))
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(expected ...string) {
+		for _, e := range expected {
+			result, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != e {
+				t.Fatalf("expected %q, got %q", e, result)
+			}
+		}
+	}
+	expect("1\n", "2\n")
+	for i := 0; i < 20; i++ {
+		expect("limited\n")
+	}
+
+	// 被拒绝的消息不消耗令牌，补充一个令牌后即可恢复
+	time.Sleep(1100 * time.Millisecond)
+	_, _ = conn.Write([]byte("4\n"))
+	expect("4\n")
+}
+
+func TestAutoBan(t *testing.T) {
+	mainServer := goserver.NewTCP("", 8091)
+	go func() {
+		_ = mainServer.SetRateLimiter(goserver.NewRateLimiter(goserver.RateLimiterConfig{
+			RateLimit: goserver.RateLimit{Rate: 1, Burst: 1},
+		}))
+		_ = mainServer.SetAutoBan(goserver.AutoBan{MaxViolations: 1, Window: time.Minute, Duration: time.Minute})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8091")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("1\n2\n3\n"))
+
+	// 超过违规次数后被封禁并断开
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	if !mainServer.IsBanned("127.0.0.1") {
+		t.Fatal("expected 127.0.0.1 banned")
+	}
+
+	// 封禁期间新连接被拒绝
+	banned, err := net.Dial("tcp", "127.0.0.1:8091")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer banned.Close()
+	_ = banned.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := banned.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("expected banned connection closed, got %d %v", n, err)
+	}
+
+	// 解除封禁后恢复
+	if err := mainServer.Unban("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	unbanned, err := net.Dial("tcp", "127.0.0.1:8091")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unbanned.Close()
+	_, _ = unbanned.Write([]byte("hello\n"))
+	_ = unbanned.SetReadDeadline(time.Now().Add(3 * time.Second))
+	result, err := bufio.NewReader(unbanned).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "hello\n" {
+		t.Fatalf("expected %q, got %q", "hello\n", result)
+	}
+}
+
+// newTestCertificate 生成测试证书，parent为nil时生成自签名CA
+func newTestCertificate(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	go func() {
+		mainServer := goserver.NewTCPWithTLS("", 8092, &tls.Config{
+			Certificates: []tls.Certificate{newTestCertificate(t, "localhost", &ca)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+			NextProtos:   []string{"test"},
+		})
+		_ = mainServer.SetTLSVerifier(func(state *tls.ConnectionState) error {
+			if state.PeerCertificates[0].Subject.CommonName != "allowed" {
+				return errors.New("client not allowed")
+			}
+			return nil
+		})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return []byte(fmt.Sprintf("%s %s %s %d\n", session.PeerCertificates()[0].Subject.CommonName, session.ServerName(), session.NegotiatedProtocol(), len(session.VerifiedChains()))), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	dial := func(commonName string) (*tls.Conn, error) {
+		return tls.Dial("tcp", "127.0.0.1:8092", &tls.Config{
+			Certificates: []tls.Certificate{newTestCertificate(t, commonName, &ca)},
+			RootCAs:      pool,
+			ServerName:   "localhost",
+			NextProtos:   []string{"test"},
+		})
+	}
+
+	conn, err := dial("allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	result, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "allowed localhost test 1\n" {
+		t.Fatalf("unexpected session tls state %q", result)
+	}
+
+	// 校验失败的客户端被断开
+	denied, err := dial("denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	_, _ = denied.Write([]byte("hello\n"))
+	_ = denied.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := bufio.NewReader(denied).ReadString('\n'); err == nil {
+		t.Fatal("expected denied connection closed")
+	}
+}
+
+// writeTestCertificate 将证书及私钥写入文件
+func writeTestCertificate(t *testing.T, cert tls.Certificate, certPath, keyPath string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	dir := t.TempDir()
+	certA, keyA := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+	certB, keyB := filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key")
+	writeTestCertificate(t, newTestCertificate(t, "a.example.com", &ca), certA, keyA)
+	writeTestCertificate(t, newTestCertificate(t, "*.b.example.com", &ca), certB, keyB)
+
+	manager := goserver.NewCertManager()
+	if err := manager.AddFile(certA, keyA); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.AddFile(certB, keyB); err != nil {
+		t.Fatal(err)
+	}
+
+	reloadErrors := make(chan error, 10)
+	go func() {
+		mainServer := goserver.NewTCPWithTLS("", 8093, nil)
+		_ = mainServer.SetCertManager(manager, 100*time.Millisecond)
+		_ = mainServer.SetOnError(func(err error) {
+			if strings.Contains(err.Error(), "reload tls certificate error") {
+				reloadErrors <- err
+			}
+		})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	// 按SNI选择证书，返回服务端证书序列号
+	serial := func(serverName string) *big.Int {
+		conn, err := tls.Dial("tcp", "127.0.0.1:8093", &tls.Config{RootCAs: pool, ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	serialA := serial("a.example.com")
+	if serial("x.b.example.com").Cmp(serialA) == 0 {
+		t.Fatal("expected wildcard certificate for x.b.example.com")
+	}
+
+	// 证书文件更新后自动重新加载
+	time.Sleep(10 * time.Millisecond)
+	writeTestCertificate(t, newTestCertificate(t, "a.example.com", &ca), certA, keyA)
+	time.Sleep(500 * time.Millisecond)
+	if serial("a.example.com").Cmp(serialA) == 0 {
+		t.Fatal("expected certificate reloaded")
+	}
+
+	// 加载失败时保留原有证书并通知错误
+	serialA = serial("a.example.com")
+	if err := os.WriteFile(certA, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloadErrors:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected reload error")
+	}
+	if serial("a.example.com").Cmp(serialA) != 0 {
+		t.Fatal("expected previous certificate kept")
+	}
+}
+
+// skipPrefixConn 首次读取前先读取明文响应
+type skipPrefixConn struct {
+	net.Conn
+	prefix []byte
+	read   bool
+}
+
+func (c *skipPrefixConn) Read(p []byte) (int, error) {
+	if !c.read {
+		c.read = true
+		if _, err := io.ReadFull(c.Conn, c.prefix); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func TestStartTLS(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "localhost", &ca)}}
+	clientConfig := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+
+	go func() {
+		mainServer := goserver.NewTCP("", 8094)
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			if string(token) == "STARTTLS" {
+				if err := session.StartTLS(serverConfig); err != nil {
+					return nil, err
+				}
+				return []byte("OK\n"), nil
+			}
+			return []byte(fmt.Sprintf("%s %v\n", token, session.TLSConnectionState() != nil)), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	c := client.NewSimpleClient(goserver.TCP, "127.0.0.1", 8094)
+	c.SetScannerSplitFunc(bufio.ScanLines)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, step := range []struct {
+		send, expected string
+	}{
+		{"hello\n", "hello false"},
+		{"STARTTLS\n", "OK"},
+		{"", ""},
+		{"hello\n", "hello true"},
+	} {
+		if step.send == "" {
+			if err := c.StartTLS(clientConfig); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := c.Send([]byte(step.send)); err != nil {
+			t.Fatal(err)
+		}
+		result, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != step.expected {
+			t.Fatalf("expected %q, got %q", step.expected, result)
+		}
+	}
+
+	// 不等待响应直接发起握手，已读取的握手数据不丢失
+	conn, err := net.Dial("tcp", "127.0.0.1:8094")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte("STARTTLS\n")); err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(&skipPrefixConn{Conn: conn, prefix: make([]byte, 3)}, clientConfig)
+	if _, err := tlsConn.Write([]byte("pipelined\n")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := bufio.NewReader(tlsConn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "pipelined true\n" {
+		t.Fatalf("expected %q, got %q", "pipelined true\n", result)
+	}
+}
+
+// lineReceiveFilter 按行拆包，每行格式为 action 数据
+type lineReceiveFilter struct{}
+
+func (f *lineReceiveFilter) SplitFunc() bufio.SplitFunc {
+	return bufio.ScanLines
+}
+
+func (f *lineReceiveFilter) ResolveAction() filter.ResolveActionFunc {
+	return func(token []byte) (string, []byte, error) {
+		fields := strings.SplitN(string(token), " ", 2)
+		if len(fields) == 1 {
+			return fields[0], nil, nil
+		}
+		return fields[0], []byte(fields[1]), nil
+	}
+}
+
+func TestAuth(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewTCP("", 8095)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.SetAuth(goserver.AuthConfig{
+			Action:        "/login",
+			MaxFrames:     2,
+			Timeout:       time.Second,
+			PublicActions: []string{"/ping"},
+			Authenticator: func(session *goserver.AppSession, token []byte) (*goserver.Identity, []byte, error) {
+				fields := strings.SplitN(string(token), ":", 2)
+				if len(fields) != 2 || fields[1] == "" {
+					return nil, []byte("retry\n"), nil
+				}
+				return &goserver.Identity{Name: fields[0], Roles: []string{fields[1]}}, []byte("welcome\n"), nil
+			},
+		})
+		_ = mainServer.Action("/ping", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return []byte("pong\n"), nil
+		})
+		_ = mainServer.Action("/whoami", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return []byte(session.Identity().Name + "\n"), nil
+		})
+		_ = mainServer.Action("/admin", goserver.RequireRoles("admin"), func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return []byte("admin\n"), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "127.0.0.1:8095")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	expect := func(conn net.Conn, reader *bufio.Reader, send, expected string) {
+		if send != "" {
+			if _, err := conn.Write([]byte(send)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		result, err := reader.ReadString('\n')
+		if expected == "" {
+			if err == nil {
+				t.Fatalf("expected connection closed, got %q", result)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != expected {
+			t.Fatalf("expected %q, got %q", expected, result)
+		}
+	}
+
+	// 认证前只能调用公开action
+	conn, reader := dial()
+	defer conn.Close()
+	expect(conn, reader, "/ping\n", "pong\n")
+	expect(conn, reader, "/whoami\n", "")
+
+	// 认证后按角色调用
+	conn, reader = dial()
+	defer conn.Close()
+	expect(conn, reader, "/login alice\n", "retry\n")
+	expect(conn, reader, "/login alice:user\n", "welcome\n")
+	_, _ = conn.Write([]byte("/admin\n"))
+	expect(conn, reader, "/whoami\n", "alice\n")
+
+	// 超过认证次数
+	conn, reader = dial()
+	defer conn.Close()
+	expect(conn, reader, "/login alice\n", "retry\n")
+	expect(conn, reader, "/login bob\n", "retry\n")
+	expect(conn, reader, "", "")
+
+	// 认证超时
+	conn, reader = dial()
+	defer conn.Close()
+	expect(conn, reader, "", "")
+}
+
+func TestAuthWithoutAction(t *testing.T) {
+	reasons := make(chan *goserver.CloseReason, 1)
+	go func() {
+		mainServer := goserver.NewTCP("", 8113)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.SetAuth(goserver.AuthConfig{
+			PublicActions: []string{"/ping"},
+			Authenticator: func(session *goserver.AppSession, token []byte) (*goserver.Identity, []byte, error) {
+				if string(token) != "secret" {
+					return nil, nil, errors.New("bad credentials")
+				}
+				return &goserver.Identity{Name: "alice"}, []byte("welcome\n"), nil
+			},
+		})
+		_ = mainServer.Action("/ping", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return []byte("pong\n"), nil
+		})
+		_ = mainServer.SetOnSessionClosedWithReason(func(session *goserver.AppSession, reason *goserver.CloseReason) {
+			reasons <- reason
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	// 未设置认证action时，认证前仍可以调用公开action
+	conn, err := net.Dial("tcp", "127.0.0.1:8113")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, step := range []struct {
+		send, expected string
+	}{
+		{"/ping\n", "pong\n"},
+		{"secret\n", "welcome\n"},
+		{"/ping\n", "pong\n"},
+	} {
+		_, _ = conn.Write([]byte(step.send))
+		result, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != step.expected {
+			t.Fatalf("expected %q, got %q", step.expected, result)
+		}
+	}
+	conn.Close()
+	<-reasons
+
+	// 认证方法返回的错误视为拒绝
+	conn, err = net.Dial("tcp", "127.0.0.1:8113")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("wrong\n"))
+	select {
+	case reason := <-reasons:
+		if reason.Kind != goserver.CloseRejected {
+			t.Fatalf("expected %s, got %s", goserver.CloseRejected, reason.Kind)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected session closed")
+	}
+}
+
+type secureModule struct{}
+
+func (m *secureModule) Root() string {
+	return "/secure"
+}
+
+func (m *secureModule) RouteOptions() map[string]goserver.RouteOptions {
+	return map[string]goserver.RouteOptions{
+		"Admin":   {Description: "admin only", Roles: []string{"admin"}},
+		"Limited": {Description: "limited", RateLimit: &goserver.RateLimit{Rate: 0.1, Burst: 1}},
+	}
+}
+
+func (m *secureModule) Public(session *goserver.AppSession, token []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("public %v\n", session.RouteOptions() == nil)), nil
+}
+
+func (m *secureModule) Admin(session *goserver.AppSession, token []byte) ([]byte, error) {
+	return []byte("admin\n"), nil
+}
+
+func (m *secureModule) Limited(session *goserver.AppSession, token []byte) ([]byte, error) {
+	return []byte(session.RouteOptions().Description + "\n"), nil
+}
+
+func TestRouteOptions(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewTCP("", 8096)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.SetAuth(goserver.AuthConfig{
+			Action: "/login",
+			Authenticator: func(session *goserver.AppSession, token []byte) (*goserver.Identity, []byte, error) {
+				return &goserver.Identity{Name: string(token), Roles: []string{string(token)}}, []byte("welcome\n"), nil
+			},
+		})
+		_ = mainServer.SetRateLimiter(goserver.NewRateLimiter(goserver.RateLimiterConfig{}))
+		_ = mainServer.RegisterBeforeMiddlewares(goserver.Middlewares{goserver.Authorize()})
+		_ = mainServer.RegisterModule(&secureModule{})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	for _, c := range []struct {
+		role     string
+		expected []string
+	}{
+		{"user", []string{"welcome\n", "limited\n", "public true\n"}},
+		{"admin", []string{"welcome\n", "admin\n", "limited\n", "public true\n"}},
+	} {
+		conn, err := net.Dial("tcp", "127.0.0.1:8096")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, _ = conn.Write([]byte("/login " + c.role + "\n/secure/admin\n/secure/limited\n/secure/limited\n/secure/public\n"))
+
+		reader := bufio.NewReader(conn)
+		for _, expected := range c.expected {
+			result, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != expected {
+				t.Fatalf("%s: expected %q, got %q", c.role, expected, result)
+			}
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := goserver.NewMetrics()
+	go func() {
+		mainServer := goserver.NewTCP("", 8097)
+		_ = mainServer.SetMetrics(metrics)
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8097")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello\nworld\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`goserver_sessions_opened_total{network="tcp"} 1`,
+		`goserver_sessions_active{network="tcp"} 1`,
+		`goserver_received_bytes_total{network="tcp"} 12`,
+		`goserver_sent_bytes_total{network="tcp"} 12`,
+		`goserver_received_frames_total{network="tcp"} 2`,
+		`goserver_sent_frames_total{network="tcp"} 2`,
+		`goserver_action_calls_total{action=""} 2`,
+		`goserver_action_duration_seconds_bucket{action="",le="+Inf"} 2`,
+		"# TYPE goserver_action_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, expected+"\n") {
+			t.Fatalf("expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	recorder := goserver.NewTraceRecorder()
+	go func() {
+		mainServer := goserver.NewTCP("", 8098)
+		_ = mainServer.SetTracer(recorder)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.RegisterBeforeMiddlewares(goserver.Middlewares{func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return token, nil
+		}})
+		_ = mainServer.Action("/echo", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8098")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("/echo hi\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	spans := recorder.Spans()
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	expected := []string{goserver.SpanResolve, goserver.SpanBeforeMiddleware, goserver.SpanAction, goserver.SpanSend, goserver.SpanMessage}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected spans %v, got %v", expected, names)
+	}
+	root := spans[len(spans)-1]
+	if root.ParentID != 0 || root.Attrs[goserver.AttrAction] != "/echo" || root.Attrs[goserver.AttrSessionID] == "" || root.Err != nil {
+		t.Fatalf("unexpected root span %+v", root)
+	}
+	for _, span := range spans[:len(spans)-1] {
+		if span.ParentID != root.ID {
+			t.Fatalf("expected span %s parent %d, got %d", span.Name, root.ID, span.ParentID)
+		}
+	}
+	if spans[3].Attrs[goserver.AttrSize] != 3 {
+		t.Fatalf("expected send size 3, got %v", spans[3].Attrs[goserver.AttrSize])
+	}
+}
+
+// syncBuffer 并发安全的缓冲区
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	logs := &syncBuffer{}
+	banner := &syncBuffer{}
+	go func() {
+		mainServer := goserver.NewTCP("", 8099)
+		_ = mainServer.SetLogger(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		_ = mainServer.SetBannerWriter(banner)
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	if !strings.Contains(banner.String(), "Listen tcp on :8099") {
+		t.Fatalf("unexpected banner %q", banner.String())
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hello\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	localAddr := conn.LocalAddr().String()
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] != "session closed" {
+			continue
+		}
+		found = true
+		if record[goserver.AttrSessionID] == "" || record[goserver.AttrRemoteAddr] != localAddr || record[goserver.AttrNetwork] != "tcp" {
+			t.Fatalf("unexpected log attributes %v", record)
+		}
+	}
+	if !found {
+		t.Fatalf("expected session closed log, got %s", logs.String())
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	mainServer := goserver.NewTCP("", 8100)
+	go func() {
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.Action("/echo", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			session.SetAttr("user", "alice")
+			return append(token, '\n'), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+	admin := mainServer.AdminHandler()
+	request := func(method, target, body string, v interface{}) {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if recorder.Code != 200 {
+			t.Fatalf("%s %s: status %d %s", method, target, recorder.Code, recorder.Body.String())
+		}
+		if v != nil {
+			if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("/echo hi\n"))
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	var routes []map[string]string
+	request("GET", "/routes", "", &routes)
+	if len(routes) != 1 || routes[0]["path"] != "/echo" {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	var sessions []map[string]interface{}
+	request("GET", "/sessions", "", &sessions)
+	if len(sessions) != 1 {
+		t.Fatalf("unexpected sessions %v", sessions)
+	}
+	session := sessions[0]
+	if session["remote_addr"] != conn.LocalAddr().String() || session["attrs"].(map[string]interface{})["user"] != "alice" ||
+		session["bytes_received"] != float64(9) || session["bytes_sent"] != float64(3) {
+		t.Fatalf("unexpected session %v", session)
+	}
+
+	var broadcast map[string]int
+	request("POST", "/broadcast", "news\n", &broadcast)
+	if broadcast["sent"] != 1 {
+		t.Fatalf("unexpected broadcast result %v", broadcast)
+	}
+	if result, err := reader.ReadString('\n'); err != nil || result != "news\n" {
+		t.Fatalf("expected broadcast message, got %q %v", result, err)
+	}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest("POST", "/broadcast", strings.NewReader(strings.Repeat("x", 2<<20))))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized broadcast rejected, got status %d", recorder.Code)
+	}
+
+	var bans map[string]interface{}
+	request("POST", "/ban?ip=10.0.0.1&duration=1m", "", nil)
+	request("GET", "/bans", "", &bans)
+	if _, exist := bans["10.0.0.1"]; !exist {
+		t.Fatalf("unexpected bans %v", bans)
+	}
+
+	request("POST", "/sessions/close?id="+session["id"].(string), "", nil)
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected session closed, got %v", err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	newServer := func(port int, upper func(token []byte) []byte) *goserver.Server {
+		server := goserver.NewTCP("", port)
+		_ = server.SetReceiveFilter(&lineReceiveFilter{})
+		_ = server.Action("/echo", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(token, '\n'), nil
+		})
+		_ = server.Action("/upper", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return append(upper(token), '\n'), nil
+		})
+		return server
+	}
+
+	buf := &syncBuffer{}
+	writer, err := capture.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainServer := newServer(8101, bytes.ToUpper)
+	_ = mainServer.SetCapture(writer)
+	go mainServer.Start()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, message := range []string{"/echo hi\n", "/upper abc\n"} {
+		_, _ = conn.Write([]byte(message))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	records, err := capture.ReadAll(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	directions := make([]string, 0, len(records))
+	for _, record := range records {
+		directions = append(directions, record.Direction.String())
+	}
+	if strings.Join(directions, ",") != "open,in,out,in,out,close" {
+		t.Fatalf("unexpected records %v", directions)
+	}
+	if records[3].Action != "/upper" || string(records[3].Payload) != "/upper abc\n" || string(records[4].Payload) != "ABC\n" {
+		t.Fatalf("unexpected records %+v", records[3:5])
+	}
+
+	if _, err := mainServer.Replay(strings.NewReader(buf.String()), goserver.ReplayConfig{}); err != goserver.ErrServerRunning {
+		t.Fatalf("expected ErrServerRunning, got %v", err)
+	}
+
+	var registered atomic.Int32
+	replayServer := newServer(0, bytes.ToUpper)
+	_ = replayServer.SetOnNewSessionRegister(func(*goserver.AppSession) {
+		registered.Add(1)
+	})
+	result, err := replayServer.Replay(strings.NewReader(buf.String()), goserver.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sessions != 1 || result.Frames != 2 || !result.OK() {
+		t.Fatalf("unexpected replay result %+v", result)
+	}
+	if registered.Load() != 0 {
+		t.Fatal("replay session should not trigger new session notification")
+	}
+
+	result, err = newServer(0, bytes.ToLower).Replay(strings.NewReader(buf.String()), goserver.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Mismatches) != 1 {
+		t.Fatalf("expected 1 mismatch, got %+v", result.Mismatches)
+	}
+	mismatch := result.Mismatches[0]
+	if mismatch.Index != 2 || mismatch.Action != "/upper" || string(mismatch.Expected) != "ABC\n" || string(mismatch.Actual) != "abc\n" {
+		t.Fatalf("unexpected mismatch %+v", mismatch)
+	}
+}
+
+func TestReplayStartTLS(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", nil)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "localhost", &ca)}}
+
+	buf := &syncBuffer{}
+	writer, err := capture.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []capture.Record{
+		{Direction: capture.Open, SessionID: "1", Payload: []byte("127.0.0.1:1234")},
+		{Direction: capture.Inbound, SessionID: "1", Action: "/starttls", Payload: []byte("/starttls\n")},
+		{Direction: capture.Outbound, SessionID: "1", Action: "/starttls", Payload: []byte("OK\n")},
+		{Direction: capture.Inbound, SessionID: "1", Action: "/echo", Payload: []byte("/echo hi\n")},
+		{Direction: capture.Outbound, SessionID: "1", Action: "/echo", Payload: []byte("hi\n")},
+		{Direction: capture.Close, SessionID: "1"},
+	} {
+		record.Time = time.Now()
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 升级tls后的数据按明文回放
+	replayServer := goserver.NewTCP("", 0)
+	_ = replayServer.SetReceiveFilter(&lineReceiveFilter{})
+	_ = replayServer.Action("/starttls", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		if err := session.StartTLS(serverConfig); err != nil {
+			return nil, err
+		}
+		return []byte("OK\n"), nil
+	})
+	_ = replayServer.Action("/echo", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		return append(token, '\n'), nil
+	})
+	result, err := replayServer.Replay(strings.NewReader(buf.String()), goserver.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sessions != 1 || result.Frames != 2 || !result.OK() {
+		t.Fatalf("unexpected replay result %+v", result)
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	sessions := make(chan *goserver.AppSession, 1)
+	go func() {
+		mainServer := goserver.NewUDP("", 8102)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetOnNewSessionRegister(func(session *goserver.AppSession) {
+			sessions <- session
+		})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			if string(token) == "fail" {
+				return nil, errors.New("fail")
+			}
+			return token, nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	c := client.NewSimpleClient(goserver.UDP, "", 8102)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send([]byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stats := (<-sessions).Stats()
+	if stats.Network != goserver.UDP || stats.RemoteAddr.String() != c.GetRawConn().LocalAddr().String() || stats.LocalAddr == nil {
+		t.Fatalf("unexpected addresses %+v", stats)
+	}
+	if stats.BytesReceived != 6 || stats.BytesSent != 2 || stats.FramesReceived != 2 || stats.FramesSent != 1 || stats.Errors != 1 {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+	if stats.LastReadAt.Before(stats.LastWriteAt) || stats.LastWriteAt.Before(stats.ConnectedAt) || stats.CurrentAction != "" {
+		t.Fatalf("unexpected times %+v", stats)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	reasons := make(chan *goserver.CloseReason, 4)
+	texts := make(chan string, 4)
+	mainServer := goserver.NewTCP("", 8103)
+	mainServer.IdleSessionTimeOut = 1
+	_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+	_ = mainServer.Action("/kick", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		session.Close("bye")
+		return nil, nil
+	})
+	_ = mainServer.SetOnSessionClosed(func(session *goserver.AppSession, reason string) {
+		texts <- reason
+	})
+	_ = mainServer.SetOnSessionClosedWithReason(func(session *goserver.AppSession, reason *goserver.CloseReason) {
+		if session.CloseReason() != reason {
+			t.Errorf("expected session close reason %v, got %v", reason, session.CloseReason())
+		}
+		reasons <- reason
+	})
+	stopped := make(chan struct{})
+	go func() {
+		mainServer.Start()
+		close(stopped)
+	}()
+	time.Sleep(time.Second)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "127.0.0.1:8103")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	expect := func(kind goserver.CloseKind, text string) {
+		select {
+		case reason := <-reasons:
+			if reason.Kind != kind || (text != "" && reason.Text != text) {
+				t.Fatalf("expected %s %q, got %s %q", kind, text, reason.Kind, reason.Text)
+			}
+			if compat := <-texts; compat != reason.Text {
+				t.Fatalf("expected reason text %q, got %q", reason.Text, compat)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected session closed with %s", kind)
+		}
+	}
+
+	conn := dial()
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	expect(goserver.CloseEOF, "EOF")
+
+	conn = dial()
+	defer conn.Close()
+	_, _ = conn.Write([]byte("/kick\n"))
+	expect(goserver.CloseKicked, "bye")
+
+	conn = dial()
+	defer conn.Close()
+	expect(goserver.CloseIdleTimeout, "")
+
+	conn = dial()
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := mainServer.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	expect(goserver.CloseServerShutdown, "server shutdown")
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected server stopped")
+	}
+	if err := mainServer.Stop(); err != goserver.ErrServerNotRunning {
+		t.Fatalf("expected ErrServerNotRunning, got %v", err)
+	}
+}
+
+func TestStopWaitsForPendingSessions(t *testing.T) {
+	mainServer := goserver.NewTCP("", 8110)
+	_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+	_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		return token, nil
+	})
+	_ = mainServer.SetSessionRegister(goserver.RegisterConfig{
+		Register: func(ctx context.Context, session *goserver.AppSession) error {
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		},
+	})
+	stopped := make(chan struct{})
+	go func() {
+		mainServer.Start()
+		close(stopped)
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// 停止时正在注册的会话注册完成后立即关闭，Start在其关闭后返回
+	if err := mainServer.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected server stopped")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("expected pending session closed, got %v", err)
+	}
+}
+
+func TestErrorContext(t *testing.T) {
+	errBoom := errors.New("boom")
+	errDenied := errors.New("denied")
+	serverErrors := make(chan *goserver.Error, 8)
+	plainErrors := make(chan error, 8)
+	var rejected atomic.Bool
+	go func() {
+		mainServer := goserver.NewTCP("", 8104)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.RegisterConnectionFilterTCP(func(conn net.Conn) error {
+			if rejected.Load() {
+				return errDenied
+			}
+			return nil
+		})
+		_ = mainServer.RegisterBeforeMiddlewares(goserver.Middlewares{func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			if string(token) == "mw" {
+				return nil, errBoom
+			}
+			return token, nil
+		}})
+		_ = mainServer.Action("/fail", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return nil, errBoom
+		})
+		_ = mainServer.SetOnError(func(err error) {
+			plainErrors <- err
+		})
+		_ = mainServer.SetOnErrorWithContext(func(err *goserver.Error) {
+			serverErrors <- err
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(phase goserver.ErrorPhase, action string, cause error, withSession bool) {
+		select {
+		case serverErr := <-serverErrors:
+			if serverErr.Phase != phase || serverErr.Action != action || !errors.Is(serverErr, cause) ||
+				(serverErr.Session != nil) != withSession || serverErr.RemoteAddr == nil {
+				t.Fatalf("unexpected error %s %q %v %+v", serverErr.Phase, serverErr.Action, serverErr, serverErr)
+			}
+			var target *goserver.Error
+			if plain := <-plainErrors; !errors.As(plain, &target) || target != serverErr {
+				t.Fatalf("expected same error for SetOnError, got %v", plain)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected %s error", phase)
+		}
+	}
+
+	_, _ = conn.Write([]byte("/fail x\n"))
+	expect(goserver.PhaseAction, "/fail", errBoom, true)
+	_, _ = conn.Write([]byte("/fail mw\n"))
+	expect(goserver.PhaseMiddleware, "/fail", errBoom, true)
+	_, _ = conn.Write([]byte("/missing\n"))
+	expect(goserver.PhaseResolve, "/missing", goserver.ErrActionNotFound, true)
+
+	rejected.Store(true)
+	conn2, err := net.Dial("tcp", "127.0.0.1:8104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	expect(goserver.PhaseFilter, "", errDenied, false)
+}
+
+func TestEventBus(t *testing.T) {
+	var lock sync.Mutex
+	var syncEvents []string
+	asyncEvents := make(chan *goserver.Event, 16)
+	mainServer := goserver.NewTCP("", 8105)
+	_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+	_ = mainServer.Action("/echo", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		return append(token, '\n'), nil
+	})
+	mainServer.Subscribe(func(event *goserver.Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		syncEvents = append(syncEvents, fmt.Sprintf("%s %s %q", event.Type, event.Action, event.Data))
+	}, goserver.SubscribeOptions{Types: []goserver.EventType{goserver.EventMessageReceived, goserver.EventMessageSent}})
+	mainServer.Subscribe(func(event *goserver.Event) {
+		asyncEvents <- event
+	}, goserver.SubscribeOptions{Async: true})
+	removed := mainServer.Subscribe(func(event *goserver.Event) {
+		t.Errorf("unexpected event %s after unsubscribe", event.Type)
+	}, goserver.SubscribeOptions{})
+	removed.Unsubscribe()
+	go mainServer.Start()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _ = conn.Write([]byte("/echo hi\n"))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	var types []string
+	var closed *goserver.Event
+	for len(types) < 5 {
+		select {
+		case event := <-asyncEvents:
+			types = append(types, event.Type.String())
+			if event.Type == goserver.EventSessionClosed {
+				closed = event
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected 5 events, got %v", types)
+		}
+	}
+	if strings.Join(types, ",") != "server_started,session_opened,message_received,message_sent,session_closed" {
+		t.Fatalf("unexpected async events %v", types)
+	}
+	if closed.Session == nil || closed.Reason == nil || closed.Reason.Kind != goserver.CloseEOF {
+		t.Fatalf("unexpected closed event %+v", closed)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{`message_received /echo "hi"`, `message_sent /echo "hi\n"`}
+	if strings.Join(syncEvents, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected sync events %v, got %v", expected, syncEvents)
+	}
+}
+
+func TestSessionRegister(t *testing.T) {
+	errFull := errors.New("server full")
+	var registered atomic.Int64
+	visible := make(chan bool, 4)
+	cancelled := make(chan error, 1)
+	mainServer := goserver.NewTCP("", 8106)
+	_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+	_ = mainServer.Action("/role", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		role, _ := session.GetAttr("role")
+		return []byte(fmt.Sprintf("%v\n", role)), nil
+	})
+	_ = mainServer.SetSessionRegister(goserver.RegisterConfig{
+		Register: func(ctx context.Context, session *goserver.AppSession) error {
+			switch registered.Add(1) {
+			case 1:
+				_, err := mainServer.GetSessionByID(session.ID)
+				visible <- err == nil
+				session.SetAttr("role", "admin")
+				return nil
+			case 2:
+				return errFull
+			default:
+				// 超时后ctx被取消
+				<-ctx.Done()
+				cancelled <- ctx.Err()
+				return ctx.Err()
+			}
+		},
+		Timeout: 200 * time.Millisecond,
+		Goodbye: func(session *goserver.AppSession, err error) []byte {
+			return []byte("bye: " + err.Error() + "\n")
+		},
+	})
+	_ = mainServer.SetOnNewSessionRegister(func(session *goserver.AppSession) {
+		_, err := session.GetAttr("role")
+		visible <- err == nil
+	})
+	go mainServer.Start()
+	time.Sleep(time.Second)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "127.0.0.1:8106")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	conn, reader := dial()
+	defer conn.Close()
+	_, _ = conn.Write([]byte("/role\n"))
+	if result, err := reader.ReadString('\n'); err != nil || result != "admin\n" {
+		t.Fatalf("expected admin, got %q %v", result, err)
+	}
+	if <-visible || !<-visible {
+		t.Fatal("expected session invisible during register and attrs set before register notification")
+	}
+
+	for _, expected := range []string{"bye: server full\n", "bye: " + goserver.ErrRegisterTimeout.Error() + "\n"} {
+		rejected, rejectedReader := dial()
+		if result, err := rejectedReader.ReadString('\n'); err != nil || result != expected {
+			t.Fatalf("expected %q, got %q %v", expected, result, err)
+		}
+		if _, err := rejectedReader.ReadString('\n'); err != io.EOF {
+			t.Fatalf("expected rejected connection closed, got %v", err)
+		}
+		rejected.Close()
+	}
+
+	if err := <-cancelled; err != context.DeadlineExceeded {
+		t.Fatalf("expected register context cancelled, got %v", err)
+	}
+
+	count := 0
+	for range mainServer.GetAllSessions() {
+		count++
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 session, got %d", count)
+	}
+}
+
+func TestUDPSessionRegister(t *testing.T) {
+	var registered atomic.Int64
+	mainServer := goserver.NewUDP("", 8108)
+	_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+	_ = mainServer.SetUDPOrderedDelivery(true)
+	_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+		return token, nil
+	})
+	_ = mainServer.SetSessionRegister(goserver.RegisterConfig{
+		Register: func(ctx context.Context, session *goserver.AppSession) error {
+			registered.Add(1)
+			switch session.ID {
+			case "slow":
+				time.Sleep(300 * time.Millisecond)
+				return nil
+			case "fast":
+				return nil
+			}
+			return errors.New("denied")
+		},
+		Goodbye: func(session *goserver.AppSession, err error) []byte {
+			return []byte("bye")
+		},
+	})
+	_ = mainServer.SetUDPConnectionID(func(datagram []byte) (string, []byte, error) {
+		i := bytes.IndexByte(datagram, '|')
+		if i < 0 {
+			return "", nil, errors.New("missing connection id")
+		}
+		return string(datagram[:i]), datagram[i+1:], nil
+	})
+	go mainServer.Start()
+	time.Sleep(time.Second)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("udp", "127.0.0.1:8108")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		return conn
+	}
+	read := func(conn net.Conn) string {
+		buffer := make([]byte, 64)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buffer[:n])
+	}
+
+	// 注册较慢的会话不阻塞其他会话，注册期间的数据报在注册后按顺序处理
+	slow := dial()
+	defer slow.Close()
+	_, _ = slow.Write([]byte("slow|1"))
+	_, _ = slow.Write([]byte("slow|2"))
+	fast := dial()
+	defer fast.Close()
+	_, _ = fast.Write([]byte("fast|hello"))
+	start := time.Now()
+	if result := read(fast); result != "hello" || time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("expected fast reply, got %q after %v", result, time.Since(start))
+	}
+	for _, expected := range []string{"1", "2"} {
+		if result := read(slow); result != expected {
+			t.Fatalf("expected %q, got %q", expected, result)
+		}
+	}
+
+	// 被拒绝的地址近期不再重新注册
+	denied := dial()
+	defer denied.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = denied.Write([]byte("denied|hello"))
+	}
+	if result := read(denied); result != "bye" {
+		t.Fatalf("expected bye, got %q", result)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if count := registered.Load(); count != 3 {
+		t.Fatalf("expected 3 registrations, got %d", count)
+	}
+}
+
+func TestRouteOptionsConcurrent(t *testing.T) {
+	// action中的会话应与新会话通知中的会话为同一对象
+	var registered atomic.Value
+	go func() {
+		mainServer := goserver.NewUDP("", 8107)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.SetOnNewSessionRegister(func(session *goserver.AppSession) {
+			registered.Store(session)
+		})
+		for _, name := range []string{"a", "b"} {
+			_ = mainServer.ActionWithOptions("/"+name, goserver.RouteOptions{Description: name}, func(session *goserver.AppSession, token []byte) ([]byte, error) {
+				// 等待其他数据报并发执行，路由信息不应被覆盖
+				time.Sleep(50 * time.Millisecond)
+				if current, _ := registered.Load().(*goserver.AppSession); current != session {
+					return []byte("session changed"), nil
+				}
+				return []byte(session.CurrentAction() + " " + session.RouteOptions().Description), nil
+			})
+		}
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("udp", "127.0.0.1:8107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		_, _ = conn.Write([]byte([]string{"/a", "/b"}[i%2]))
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	results := make(map[string]int)
+	buffer := make([]byte, 64)
+	for i := 0; i < count; i++ {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[string(buffer[:n])]++
+	}
+	if results["/a a"] != count/2 || results["/b b"] != count/2 {
+		t.Fatalf("unexpected results %v", results)
+	}
+}
+
+func TestUDPOrderedQueueLimit(t *testing.T) {
+	release := make(chan struct{})
+	var registered atomic.Value
+	go func() {
+		mainServer := goserver.NewUDP("", 8111)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetUDPOrderedDelivery(true)
+		_ = mainServer.SetReceiveFilter(&lineReceiveFilter{})
+		_ = mainServer.SetOnNewSessionRegister(func(session *goserver.AppSession) {
+			registered.Store(session)
+		})
+		_ = mainServer.Action("/block", func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			// 阻塞处理，后续数据报在队列中排队
+			<-release
+			return nil, nil
+		})
+		mainServer.Start()
+	}()
+	defer close(release)
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("udp", "127.0.0.1:8111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 400; i++ {
+		_, _ = conn.Write([]byte("/block"))
+		if i%50 == 0 {
+			// 避免超出socket接收缓冲区被系统丢弃
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	session, _ := registered.Load().(*goserver.AppSession)
+	if session == nil {
+		t.Fatal("session not registered")
+	}
+	if dropped := session.Stats().DatagramsDropped; dropped == 0 {
+		t.Fatalf("expected datagrams to be dropped when the queue is full, %+v", session.Stats())
+	}
+}
+
+func TestStartTLSHandshakeNotBlocking(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", nil)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "localhost", &ca)}}
+
+	var registered atomic.Value
+	go func() {
+		mainServer := goserver.NewTCP("", 8112)
+		_ = mainServer.SetOnNewSessionRegister(func(session *goserver.AppSession) {
+			registered.Store(session)
+		})
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			if err := session.StartTLS(serverConfig); err != nil {
+				return nil, err
+			}
+			return []byte("OK\n"), nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8112")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte("STARTTLS\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端未发起握手，服务端握手期间仍可以获取会话信息
+	session, _ := registered.Load().(*goserver.AppSession)
+	if session == nil {
+		t.Fatal("session not registered")
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = session.RemoteAddr()
+		_ = session.TLSConnectionState()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("session blocked by tls handshake")
+	}
+}
+
+func TestRateLimitDelayDatagram(t *testing.T) {
+	go func() {
+		mainServer := goserver.NewUDP("", 8114)
+		_ = mainServer.SetUDPMode(goserver.UDPModeDatagram)
+		_ = mainServer.SetUDPDatagramWorkers(1)
+		_ = mainServer.SetRateLimiter(goserver.NewRateLimiter(goserver.RateLimiterConfig{
+			RateLimit: goserver.RateLimit{Rate: 1, Burst: 1},
+			Action:    goserver.RateLimitDelay,
+			MaxDelay:  2 * time.Second,
+		}))
+		_ = mainServer.SetOnMessage(func(session *goserver.AppSession, token []byte) ([]byte, error) {
+			return token, nil
+		})
+		mainServer.Start()
+	}()
+	time.Sleep(time.Second)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("udp", "127.0.0.1:8114")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	slow, fast := dial(), dial()
+	defer slow.Close()
+	defer fast.Close()
+
+	// 第二条消息等待令牌，第三条消息因已有消息等待被丢弃
+	for _, message := range []string{"1", "2", "3"} {
+		_, _ = slow.Write([]byte(message))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 等待限流的消息不占用协程名额，其他会话的消息立即处理
+	start := time.Now()
+	_, _ = fast.Write([]byte("fast"))
+	buffer := make([]byte, 16)
+	_ = fast.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := fast.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "fast" || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("unexpected reply %q after %v", buffer[:n], time.Since(start))
+	}
+
+	var replies []string
+	_ = slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := slow.Read(buffer)
+		if err != nil {
+			break
+		}
+		replies = append(replies, string(buffer[:n]))
+	}
+	if strings.Join(replies, ",") != "1,2" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+}
@@ -1,19 +1,22 @@
 package goserver
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
-	"log/slog"
 	"net"
+	"os"
 	"sync"
 	"time"
 
-	"github.com/pkg/errors"
+	"github.com/zboyco/go-server/arq"
+	"github.com/zboyco/go-server/capture"
+	"github.com/zboyco/go-server/fragment"
 )
 
+const udpQueueDepth = 256 // 数据报顺序投递时每个会话最多排队的数据报数量
+
 // New 新建一个tcp服务
 func NewUDP(ip string, port int) *Server {
 	return newServer(UDP, ip, port, nil)
@@ -24,22 +27,51 @@ func (server *Server) startUDP(addr string) {
 	// 解析地址
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		server.handleOnError(errors.Wrap(err, "resolve udp addr error"))
+		server.handleOnError(newError(PhaseAccept, nil, err, "resolve udp addr error"))
 		return
 	}
 
 	// 监听UDP连接
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		server.handleOnError(errors.Wrap(err, "listen udp error"))
-		return
+	var udpConn *net.UDPConn
+	if len(server.multicastGroups) > 0 {
+		udpConn, err = server.listenMulticast(udpAddr.Port)
+		if err != nil {
+			server.handleOnError(newError(PhaseAccept, nil, err, "listen udp multicast error"))
+			return
+		}
+	} else {
+		udpConn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			server.handleOnError(newError(PhaseAccept, nil, err, "listen udp error"))
+			return
+		}
 	}
 
 	// 程序返回后关闭socket
 	defer udpConn.Close()
 
-	// 开启会话池管理
-	go server.sessionSource.sessionPoolManager()
+	server.udpConn.Store(udpConn)
+	defer server.udpConn.Store((*net.UDPConn)(nil))
+
+	server.closeListener.Store(func() { _ = udpConn.Close() })
+	defer server.closeListener.Store((func())(nil))
+
+	// 可靠模式握手器，每次启动使用新的密钥
+	if server.udpMode == UDPModeReliable {
+		server.arqHandshaker = arq.NewHandshaker()
+	}
+
+	// 数据报模式并发处理时限制协程数量
+	if server.udpMode == UDPModeDatagram && !server.udpOrdered {
+		server.udpWorkerSlots = make(chan struct{}, server.udpWorkers)
+	}
+
+	// 数据报模式下统一检测会话超时，监听结束时退出
+	if server.udpMode == UDPModeDatagram {
+		sweeperDone := make(chan struct{})
+		defer close(sweeperDone)
+		go server.udpSessionSweeper(sweeperDone)
+	}
 
 	var wg sync.WaitGroup
 
@@ -47,43 +79,118 @@ func (server *Server) startUDP(addr string) {
 	go func() {
 		defer wg.Done()
 
-		bufferLength := 4 * 1024
+		bufferLength := server.udpReadBufferSize
+		if bufferLength <= 0 {
+			bufferLength = 4 * 1024
+		}
 		for {
 			// 开始接收udp数据
 			buffer := make([]byte, bufferLength)
 			n, clientAddr, err := udpConn.ReadFromUDP(buffer)
 			if err != nil {
-				server.handleOnError(errors.Wrap(err, "read udp error"))
+				if server.stopping.Load() {
+					return
+				}
+				server.handleOnError(newError(PhaseAccept, nil, err, "read udp error"))
 				continue
 			}
+			if n == bufferLength {
+				server.log().Warn("udp datagram may be truncated", AttrRemoteAddr, clientAddr.String(), AttrNetwork, string(UDP), "buffer_size", bufferLength)
+			}
 			server.handleUDPClient(udpConn, clientAddr, buffer[:n])
 		}
 	}()
 
 	server.printServerInfo()
+	server.events.publish(&Event{Type: EventServerStarted})
 
 	wg.Wait()
+	server.closeAllSessions()
+	server.handlers.Wait()
 }
 
 // handleTCPClient 读取数据
 func (server *Server) handleUDPClient(conn net.Conn, clientAddr *net.UDPAddr, data []byte) {
+	server.metrics.BytesReceived(UDP, len(data))
+
+	// 丢弃已封禁IP的数据
+	if server.banList.isBanned(clientAddr.IP) {
+		server.metrics.ConnectionRejected(UDP, "banned")
+		return
+	}
+
 	// 连接过滤器
 	if server.connectionFilterUDP != nil {
 		for i := range server.connectionFilterUDP {
 			if err := server.connectionFilterUDP[i](clientAddr); err != nil {
-				slog.Warn(fmt.Sprintf("connect[%s] filter because %s", clientAddr.String(), err.Error()))
+				server.handleOnError(newAddrError(PhaseFilter, clientAddr, err, "connection filtered"))
+				server.metrics.ConnectionRejected(UDP, "filter")
 				return
 			}
 		}
 	}
 
-	// 计算MD5
-	md5Sum := md5.Sum([]byte(clientAddr.String()))
-	// 生成会话ID
-	sessionID := hex.EncodeToString(md5Sum[:])
+	var sessionID string
+	if server.udpConnectionID != nil {
+		// 使用数据报中携带的连接ID作为会话ID
+		connID, payload, err := server.udpConnectionID(data)
+		if err != nil {
+			server.handleOnError(newAddrError(PhaseAccept, clientAddr, err, "resolve udp connection id error"))
+			return
+		}
+		sessionID = connID
+		data = payload
+	} else {
+		// 计算MD5
+		md5Sum := md5.Sum([]byte(clientAddr.String()))
+		// 生成会话ID
+		sessionID = hex.EncodeToString(md5Sum[:])
+	}
 
+	// 正在注册的会话缓存数据报，近期被拒绝的地址丢弃数据报
+	if server.udpRegistering(sessionID, clientAddr, data) {
+		return
+	}
+
+	// 正在关闭的会话视为不存在，创建新会话替换
 	session, _ := server.GetSessionByID(sessionID)
+	if session != nil && session.isClosed() {
+		session = nil
+	}
+	if session != nil && server.udpConnectionID != nil {
+		// 地址变化时校验通过后迁移会话，否则丢弃数据报
+		if oldAddr := session.getUDPAddr(); oldAddr.String() != clientAddr.String() {
+			if err := server.verifyUDPMigration(session, clientAddr, data); err != nil {
+				server.handleOnError(newAddrError(PhaseFilter, clientAddr, err, fmt.Sprintf("udp session [%s] migration rejected", sessionID)))
+				server.metrics.ConnectionRejected(UDP, "migration")
+				return
+			}
+			server.migrateUDPSession(session, oldAddr, clientAddr)
+		}
+	}
 	if session == nil {
+		// 可靠模式下对端完成握手后才创建会话
+		var conv uint32
+		if server.udpMode == UDPModeReliable {
+			var reply []byte
+			var ok bool
+			conv, reply, ok = server.arqHandshaker.Accept(clientAddr, data)
+			if reply != nil {
+				if _, err := conn.(*net.UDPConn).WriteToUDP(reply, clientAddr); err != nil {
+					server.handleOnError(newAddrError(PhaseAccept, clientAddr, err, "send udp reliable handshake error"))
+				}
+			}
+			if !ok {
+				return
+			}
+		}
+
+		// 连接限制
+		releaseConnection, ok := server.acquireConnection(clientAddr)
+		if !ok {
+			return
+		}
+
 		// 创建会话对象
 		session = &AppSession{
 			ID:               sessionID,
@@ -92,37 +199,195 @@ func (server *Server) handleUDPClient(conn net.Conn, clientAddr *net.UDPAddr, da
 			attr:             make(map[string]interface{}),
 			sendPacketFilter: server.sendPacketFilter,
 
-			udpAddr:         clientAddr,
-			udpReadDeadline: time.Now().Add(server.idleSessionTimeOutDuration),
-			udpClientIO:     NewSafeByteSlice(),
+			udpAddr:       clientAddr,
+			connectedAt:   time.Now(),
+			metrics:       server.metrics,
+			logger:        server.sessionLogger(sessionID),
+			captureWriter: server.capture,
+			events:        server.events,
+
+			releaseConnection: releaseConnection,
+		}
+		// 设置初始超时时间，避免首次处理数据前被超时检测关闭
+		session.udpReadDeadline.Store(time.Now().Add(server.idleSessionTimeOutDuration).UnixNano())
+		if server.fragmentConfig != nil && server.udpMode != UDPModeReliable {
+			session.fragmentSplitter = server.fragmentSplitter
+			session.fragmentReassembler = server.fragmentGroup.NewReassembler()
+		}
+		switch server.udpMode {
+		case UDPModeDatagram:
+			if server.udpOrdered {
+				session.udpQueue = &datagramQueue{}
+			} else {
+				session.udpWorkerSlots = server.udpWorkerSlots
+			}
+		case UDPModeReliable:
+			udpConn := conn.(*net.UDPConn)
+			session.arq = arq.NewConn(conv, server.arqConfig, udpConn.LocalAddr(), clientAddr, func(b []byte) error {
+				_, err := udpConn.WriteToUDP(b, session.getUDPAddr())
+				return err
+			})
+		default:
+			session.udpClientIO = NewSafeByteSlice()
 		}
 		// 设置会话关闭触发器
 		session.closeTrigger = server.closeSessionTrigger(session)
 
-		// 获取连接地址
-		slog.Debug(fmt.Sprintf("client[%s] address: %s", session.ID, clientAddr.String()))
-
-		// 新客户端接入通知
-		if server.onNewSessionRegister != nil {
-			server.onNewSessionRegister(session)
+		// 在单独的协程中注册，注册成功后处理数据
+		if server.register != nil {
+			server.registerUDPSession(session, data)
+			return
 		}
+		server.openUDPSession(session)
+	}
 
-		// 注册Session
-		server.sessionSource.addSession(session)
+	server.udpInput(session, data)
+}
+
+// openUDPSession 会话加入会话池并开始处理数据
+func (server *Server) openUDPSession(session *AppSession) {
+	session.log().Debug("session connected")
+
+	// 开始认证超时检测
+	server.startAuthTimer(session)
+
+	// 新客户端接入通知
+	if server.onNewSessionRegister != nil {
+		server.onNewSessionRegister(session)
+	}
 
+	// 注册Session
+	server.sessionSource.addSession(session)
+	server.metrics.SessionOpened(UDP)
+	session.capture(capture.Open, "", []byte(session.getUDPAddr().String()))
+	server.events.publish(&Event{Type: EventSessionOpened, Session: session})
+	server.closeIfStopping(session)
+
+	switch server.udpMode {
+	case UDPModeDatagram:
+	case UDPModeReliable:
+		// 可靠模式与tcp相同，按流读取，由读超时检测闲置
+		go server.serveStream(session, session.arq)
+	default:
 		// 启动超时检测
 		go server.udpReadTimeout(session)
 
 		// 启动数据分离
 		go server.udpSplitData(session)
 	}
+}
+
+// udpInput 处理会话收到的数据报
+func (server *Server) udpInput(session *AppSession, data []byte) {
+	session.received(len(data))
 
 	// 更新超时时间
-	session.udpReadDeadline = time.Now().Add(server.idleSessionTimeOutDuration)
+	session.udpReadDeadline.Store(time.Now().Add(server.idleSessionTimeOutDuration).UnixNano())
+
+	// 分片重组，未分片的数据报按原样处理
+	if session.fragmentReassembler != nil && fragment.IsFragment(data) {
+		message, err := session.fragmentReassembler.Input(data)
+		if err != nil {
+			server.handleOnError(newError(PhaseSplit, session, err, "reassemble udp fragment error"))
+			return
+		}
+		if message == nil {
+			return
+		}
+		data = message
+	}
+
+	switch server.udpMode {
+	case UDPModeReliable:
+		// 交给可靠传输层处理确认及重排
+		if err := session.arq.Input(data); err != nil {
+			server.handleOnError(newError(PhaseSplit, session, err, "input udp reliable segment error"))
+		}
+		return
+	case UDPModeDatagram:
+		// 数据报直接投递
+		if session.udpQueue != nil {
+			// 队列已满时丢弃，避免处理缓慢的会话占用过多内存
+			if !session.udpQueue.push(data, func(data []byte) {
+				server.udpHandleDatagram(session, data)
+			}) {
+				session.datagramsDropped.Add(1)
+				session.log().Debug("udp datagram dropped", "reason", "queue full")
+			}
+		} else {
+			// 并发处理，达到协程数量上限时等待
+			server.udpWorkerSlots <- struct{}{}
+			go func() {
+				defer func() { <-server.udpWorkerSlots }()
+				server.udpHandleDatagram(session, data)
+			}()
+		}
+		return
+	}
+
 	// 将读取的数据写入 buffer
 	_, _ = session.udpClientIO.Write(data)
 }
 
+// verifyUDPMigration 校验会话是否可以迁移到新地址
+func (server *Server) verifyUDPMigration(session *AppSession, newAddr *net.UDPAddr, payload []byte) error {
+	if session.isClosed() || server.udpMigration == nil {
+		return ErrMigrationDenied
+	}
+	return server.udpMigration(session, newAddr, payload)
+}
+
+// migrateUDPSession 将会话迁移到新地址
+func (server *Server) migrateUDPSession(session *AppSession, oldAddr, newAddr *net.UDPAddr) {
+	session.setUDPAddr(newAddr)
+	if session.arq != nil {
+		session.arq.SetRemoteAddr(newAddr)
+	}
+	session.log().Debug("session migrated", "old_addr", oldAddr.String(), "new_addr", newAddr.String())
+
+	// 会话迁移通知
+	if server.onSessionMigrated != nil {
+		server.onSessionMigrated(session, oldAddr, newAddr)
+	}
+}
+
+// udpHandleDatagram 处理单个数据报
+func (server *Server) udpHandleDatagram(session *AppSession, data []byte) {
+	if session.isClosed() {
+		return
+	}
+	if err := server.handleToken(session, data, data); err != nil {
+		server.handleOnError(wrapError(PhaseSplit, session, err, "resolve udp datagram error"))
+		if isProtocolError(err) {
+			server.recordViolation(session)
+		}
+		server.closeSession(session, readCloseReason(err))
+	}
+}
+
+// udpSessionSweeper 数据报模式下的会话超时检测
+// 由单个协程轮询所有会话，避免为每个会话启动协程，done关闭时退出
+func (server *Server) udpSessionSweeper(done <-chan struct{}) {
+	if server.IdleSessionTimeOut <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		for session := range server.GetAllSessions() {
+			if !session.isClosed() && now.UnixNano() > session.udpReadDeadline.Load() {
+				server.closeSession(session, server.udpTimeoutReason(session))
+			}
+		}
+	}
+}
+
 // udpReadTimeout 读取超时
 func (server *Server) udpReadTimeout(session *AppSession) {
 	if server.IdleSessionTimeOut <= 0 {
@@ -130,62 +395,114 @@ func (server *Server) udpReadTimeout(session *AppSession) {
 	}
 	for {
 		time.Sleep(time.Second)
-		if time.Now().After(session.udpReadDeadline) {
-			ip := "127.0.0.1"
-			if server.ip != "" {
-				ip = server.ip
-			}
-			server.closeSession(session, fmt.Sprintf("read udp %s:%d->%s: i/o timeout", ip, server.port, session.udpAddr.String()))
+		if session.isClosed() {
+			return
+		}
+		if time.Now().UnixNano() > session.udpReadDeadline.Load() {
+			server.closeSession(session, server.udpTimeoutReason(session))
 			return
 		}
 	}
 }
 
+// udpTimeoutReason 生成udp会话闲置超时的关闭原因，描述与tcp读超时错误格式相同
+func (server *Server) udpTimeoutReason(session *AppSession) *CloseReason {
+	ip := "127.0.0.1"
+	if server.ip != "" {
+		ip = server.ip
+	}
+	return &CloseReason{
+		Kind: CloseIdleTimeout,
+		Err:  os.ErrDeadlineExceeded,
+		Text: fmt.Sprintf("read udp %s:%d->%s: i/o timeout", ip, server.port, session.getUDPAddr().String()),
+	}
+}
+
 // udpSplitData 数据拆分
 func (server *Server) udpSplitData(session *AppSession) {
 	var err error
 
 	for {
 		// 创建scanner
-		scanner := bufio.NewScanner(session.udpClientIO)
-		if server.maxScanTokenSize > 0 {
-			if server.maxScanTokenSize > 4*1024 {
-				scanner.Buffer(make([]byte, 0, 4*1024), server.maxScanTokenSize)
-			} else {
-				scanner.Buffer(make([]byte, 0, server.maxScanTokenSize), server.maxScanTokenSize)
-			}
-		}
-
-		// 设置分离函数
-		scanner.Split(server.splitFunc)
+		state := &scanState{}
+		scanner := server.newScanner(session.udpClientIO, state)
 
 		// 获取数据
 		for scanner.Scan() {
-			token := scanner.Bytes()
-			actionName := ""
-			if server.resolveAction != nil {
-				actionName, token, err = server.resolveAction(token)
-				if err != nil {
-					break
-				}
-			}
-			hookErr := server.hookAction(actionName, session, token)
-			if hookErr != nil {
-				server.handleOnError(hookErr)
+			err = server.handleToken(session, state.frame, scanner.Bytes())
+			if err != nil {
+				break
 			}
 		}
 
 		// 错误处理
 		if err == nil {
-			err = scanner.Err()
+			if err = scanner.Err(); err != nil {
+				session.errorCount.Add(1)
+			}
 		}
 		if err != nil {
 			break
 		}
 	}
 
-	server.handleOnError(errors.Wrap(err, "scan udp error"))
-	server.closeSession(session, err.Error())
+	server.handleOnError(wrapError(PhaseSplit, session, err, "scan udp error"))
+	if isProtocolError(err) {
+		server.recordViolation(session)
+	}
+	server.closeSession(session, readCloseReason(err))
+}
+
+// datagramQueue 数据报顺序投递队列
+// 队列非空时才启动协程依次处理，处理完毕后协程退出，最多缓存udpQueueDepth个数据报
+type datagramQueue struct {
+	items   [][]byte
+	running bool
+	sync.Mutex
+}
+
+// push 加入队列，如无处理协程则启动，队列已满时丢弃并返回false
+func (q *datagramQueue) push(data []byte, handle func([]byte)) bool {
+	q.Lock()
+	if len(q.items) >= udpQueueDepth {
+		q.Unlock()
+		return false
+	}
+	q.items = append(q.items, data)
+	if q.running {
+		q.Unlock()
+		return true
+	}
+	q.running = true
+	q.Unlock()
+
+	go q.drain(handle)
+	return true
+}
+
+// drain 依次处理队列中的数据报
+func (q *datagramQueue) drain(handle func([]byte)) {
+	for {
+		q.Lock()
+		if len(q.items) == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+		data := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.Unlock()
+
+		handle(data)
+	}
+}
+
+// len 返回队列中的数据报数量
+func (q *datagramQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
 }
 
 // SafeByteSlice 实现了 io.ReadWriter 接口，并通过互斥锁保证了并发安全性
@@ -214,3 +531,11 @@ func (s *SafeByteSlice) Write(p []byte) (n int, err error) {
 
 	return s.buffer.Write(p)
 }
+
+// Len 返回未读取的字节数
+func (s *SafeByteSlice) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.buffer.Len()
+}
@@ -1,12 +1,23 @@
 package goserver
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/zboyco/go-server/arq"
+	"github.com/zboyco/go-server/capture"
+	"github.com/zboyco/go-server/fragment"
+	"github.com/zboyco/go-server/proxyproto"
 )
 
 // AppSession 客户端结构体
@@ -14,37 +25,319 @@ type AppSession struct {
 	ID               string                 // 连接唯一标识
 	IsClosed         bool                   // 标记会话是否关闭
 	attr             map[string]interface{} // 会话自定义属性
+	attrLock         sync.RWMutex           // 会话属性锁
 	sendPacketFilter Middlewares            // 发送数据过滤
 
-	network Network  // 传输协议
-	conn    net.Conn // socket连接
+	network     Network              // 传输协议
+	conn        net.Conn             // socket连接
+	connLock    sync.RWMutex         // 连接锁，升级tls时替换连接
+	upgradeLock sync.RWMutex         // tls升级锁，握手期间暂停发送
+	proxyHeader *proxyproto.Header   // PROXY protocol头部
+	tlsState    *tls.ConnectionState // tls握手后的连接状态
+	pendingTLS  *tls.Config          // 当前action响应发送后需要升级的tls配置
+
+	udpAddr          *net.UDPAddr   // udp地址
+	udpAddrLock      sync.RWMutex   // udp地址锁，连接迁移时更新地址
+	udpClientIO      io.ReadWriter  // 用于udp客户端
+	udpReadDeadline  atomic.Int64   // 超时时间(UnixNano),用于udp超时检测
+	udpQueue         *datagramQueue // 数据报顺序投递队列
+	datagramsDropped atomic.Int64   // 顺序投递队列已满丢弃的数据报数量
+	udpWorkerSlots   chan struct{}  // 数据报并发处理的协程名额，限流等待期间归还
+	rateDelaying     atomic.Bool    // 是否有消息正在等待限流延迟
+	arq              *arq.Conn      // 可靠模式传输连接
+
+	fragmentSplitter    *fragment.Splitter    // udp发送分片器
+	fragmentReassembler *fragment.Reassembler // udp分片重组器
+
+	currentAction atomic.Value // 最近开始执行的action路径，用于统计
+	routes        sync.Map     // 正在执行的action路由信息，按执行协程区分(*routeContext)
+	routeCount    atomic.Int32 // 正在执行的action数量
+
+	identity   atomic.Value // 认证身份(*Identity)
+	authFrames atomic.Int64 // 认证阶段已接收的数据数量
+	authTimer  *time.Timer  // 认证超时定时器
 
-	udpAddr         *net.UDPAddr  // udp地址
-	udpClientIO     io.ReadWriter // 用于udp客户端
-	udpReadDeadline time.Time     // 超时时间,用于udp超时检测
+	connectedAt time.Time    // 会话建立时间
+	lastReadAt  atomic.Int64 // 最后接收数据时间(UnixNano)
+	lastWriteAt atomic.Int64 // 最后发送数据时间(UnixNano)
+	bytesIn     atomic.Int64 // 接收字节数
+	bytesOut    atomic.Int64 // 发送字节数
+	framesIn    atomic.Int64 // 接收消息数
+	framesOut   atomic.Int64 // 发送消息数
+	errorCount  atomic.Int64 // 错误数
 
-	closeTrigger func(reason string) // 会话关闭触发器
+	metrics MetricsRecorder // 指标记录器
+	logger  *slog.Logger    // 会话日志，附带会话ID及传输协议
+
+	captureWriter *capture.Writer // 流量录制
+	events        *eventBus       // 事件总线
+
+	closeOnce         sync.Once                 // 保证会话只关闭一次
+	closed            atomic.Bool               // 会话是否关闭，内部并发判断时使用
+	closeReason       atomic.Value              // 会话关闭原因(*CloseReason)
+	closeTrigger      func(reason *CloseReason) // 会话关闭触发器
+	releaseConnection func()                    // 释放连接限制名额
 }
 
 // SendRaw 发送原始数据
 func (session *AppSession) SendRaw(buf []byte) error {
-	if session.IsClosed {
+	if session.isClosed() {
 		return errors.New("session is closed")
 	}
 
+	if err := session.write(buf); err != nil {
+		session.errorCount.Add(1)
+		// tcp连接写入失败后无法继续使用
+		if session.network == TCP {
+			go session.close(newCloseReason(CloseWriteFailed, err))
+		}
+		return err
+	}
+	session.lastWriteAt.Store(time.Now().UnixNano())
+	session.bytesOut.Add(int64(len(buf)))
+	session.framesOut.Add(1)
+	session.metrics.BytesSent(session.network, len(buf))
+	session.metrics.FrameSent(session.network)
+	session.capture(capture.Outbound, session.CurrentAction(), buf)
+	session.events.publishMessage(EventMessageSent, session, session.CurrentAction(), buf)
+	return nil
+}
+
+// capture 录制会话流量，未开启录制时不处理
+func (session *AppSession) capture(direction capture.Direction, action string, payload []byte) {
+	if session.captureWriter == nil {
+		return
+	}
+	err := session.captureWriter.Write(capture.Record{
+		Time:      time.Now(),
+		Direction: direction,
+		SessionID: session.ID,
+		Action:    action,
+		Payload:   payload,
+	})
+	if err != nil {
+		session.log().Error("write capture error", "error", err.Error())
+	}
+}
+
+// write 写入连接，udp会话按传输方式发送
+func (session *AppSession) write(buf []byte) error {
 	switch session.network {
 	case TCP:
-		if _, err := session.conn.Write(buf); err != nil {
+		session.upgradeLock.RLock()
+		defer session.upgradeLock.RUnlock()
+		if _, err := session.getConn().Write(buf); err != nil {
 			return err
 		}
 	case UDP:
-		if _, err := session.conn.(*net.UDPConn).WriteToUDP(buf, session.udpAddr); err != nil {
+		if session.arq != nil {
+			if _, err := session.arq.Write(buf); err != nil {
+				return err
+			}
+			return nil
+		}
+		if session.fragmentSplitter != nil {
+			fragments, err := session.fragmentSplitter.Split(buf)
+			if err != nil {
+				return err
+			}
+			for _, fragment := range fragments {
+				if _, err := session.conn.(*net.UDPConn).WriteToUDP(fragment, session.getUDPAddr()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if _, err := session.conn.(*net.UDPConn).WriteToUDP(buf, session.getUDPAddr()); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// RemoteAddr 获取客户端地址
+// 开启PROXY protocol时为头部中的客户端原始地址
+func (session *AppSession) RemoteAddr() net.Addr {
+	if session.network == UDP {
+		return session.getUDPAddr()
+	}
+	return session.getConn().RemoteAddr()
+}
+
+// LocalAddr 获取服务端地址
+// 开启PROXY protocol时为代理接收连接的原始地址
+func (session *AppSession) LocalAddr() net.Addr {
+	return session.getConn().LocalAddr()
+}
+
+// ProxyHeader 获取PROXY protocol头部，包含原始地址及扩展信息
+// 未开启或连接未携带头部时返回nil
+func (session *AppSession) ProxyHeader() *proxyproto.Header {
+	return session.proxyHeader
+}
+
+// TLSConnectionState 获取tls连接状态，非tls会话返回nil
+func (session *AppSession) TLSConnectionState() *tls.ConnectionState {
+	session.connLock.RLock()
+	defer session.connLock.RUnlock()
+	return session.tlsState
+}
+
+// PeerCertificates 获取客户端证书，客户端未提供证书时返回nil
+func (session *AppSession) PeerCertificates() []*x509.Certificate {
+	state := session.TLSConnectionState()
+	if state == nil {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// VerifiedChains 获取已验证的客户端证书链
+func (session *AppSession) VerifiedChains() [][]*x509.Certificate {
+	state := session.TLSConnectionState()
+	if state == nil {
+		return nil
+	}
+	return state.VerifiedChains
+}
+
+// ServerName 获取客户端请求的服务器名称(SNI)
+func (session *AppSession) ServerName() string {
+	state := session.TLSConnectionState()
+	if state == nil {
+		return ""
+	}
+	return state.ServerName
+}
+
+// NegotiatedProtocol 获取协商的应用层协议(ALPN)
+func (session *AppSession) NegotiatedProtocol() string {
+	state := session.TLSConnectionState()
+	if state == nil {
+		return ""
+	}
+	return state.NegotiatedProtocol
+}
+
+// StartTLS 将明文会话升级为tls，只能在action中调用
+// 当前action的响应以明文发送后，服务端开始tls握手，之后的数据均通过tls传输
+func (session *AppSession) StartTLS(config *tls.Config) error {
+	if session.network != TCP || config == nil || session.TLSConnectionState() != nil {
+		return ErrStartTLS
+	}
+	session.pendingTLS = config
+	return nil
+}
+
+// takePendingTLS 取出待升级的tls配置
+func (session *AppSession) takePendingTLS() *tls.Config {
+	config := session.pendingTLS
+	session.pendingTLS = nil
+	return config
+}
+
+// getConn 获取socket连接
+func (session *AppSession) getConn() net.Conn {
+	session.connLock.RLock()
+	defer session.connLock.RUnlock()
+	return session.conn
+}
+
+// Identity 获取认证身份，未认证时返回nil
+func (session *AppSession) Identity() *Identity {
+	identity, _ := session.identity.Load().(*Identity)
+	return identity
+}
+
+// CurrentAction 获取当前正在执行的action路径
+// 可在中间件中使用，未执行action时返回空字符串
+func (session *AppSession) CurrentAction() string {
+	if route := session.currentRoute(); route != nil {
+		return route.action
+	}
+	action, _ := session.currentAction.Load().(string)
+	return action
+}
+
+// RouteOptions 获取当前正在执行的action的路由选项
+// 可在中间件中使用，未执行action或action未设置选项时返回nil
+// 仅在执行action的协程中有效，数据报模式并发处理消息时各消息互不影响
+func (session *AppSession) RouteOptions() *RouteOptions {
+	if route := session.currentRoute(); route != nil {
+		return route.options
+	}
+	return nil
+}
+
+// routeContext 正在执行的action路由信息
+type routeContext struct {
+	action  string        // action路径
+	options *RouteOptions // 路由选项
+}
+
+// enterRoute 记录当前协程正在执行的action，返回结束执行时调用的方法
+func (session *AppSession) enterRoute(action string, options *RouteOptions) func() {
+	id := goroutineID()
+	session.routes.Store(id, &routeContext{action: action, options: options})
+	session.routeCount.Add(1)
+	return func() {
+		session.routes.Delete(id)
+		session.routeCount.Add(-1)
+	}
+}
+
+// currentRoute 获取当前协程正在执行的action路由信息，不在action中时返回nil
+func (session *AppSession) currentRoute() *routeContext {
+	if session.routeCount.Load() == 0 {
+		return nil
+	}
+	value, _ := session.routes.Load(goroutineID())
+	route, _ := value.(*routeContext)
+	return route
+}
+
+// goroutineID 获取当前协程编号
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	// 格式为 "goroutine 123 [running]:"
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// log 获取会话日志，附带客户端地址及正在执行的action
+func (session *AppSession) log() *slog.Logger {
+	logger := session.logger
+	if logger == nil {
+		logger = slog.Default().With(AttrSessionID, session.ID, AttrNetwork, string(session.network))
+	}
+	logger = logger.With(AttrRemoteAddr, session.RemoteAddr().String())
+	if action := session.CurrentAction(); action != "" {
+		logger = logger.With(AttrAction, action)
+	}
+	return logger
+}
+
+// getUDPAddr 获取udp地址
+func (session *AppSession) getUDPAddr() *net.UDPAddr {
+	session.udpAddrLock.RLock()
+	defer session.udpAddrLock.RUnlock()
+	return session.udpAddr
+}
+
+// setUDPAddr 更新udp地址，返回原地址
+func (session *AppSession) setUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	session.udpAddrLock.Lock()
+	defer session.udpAddrLock.Unlock()
+	oldAddr := session.udpAddr
+	session.udpAddr = addr
+	return oldAddr
+}
+
 // Send 发送打包后的数据
 func (session *AppSession) Send(buf []byte) error {
 	var err error
@@ -58,25 +351,106 @@ func (session *AppSession) Send(buf []byte) error {
 	return session.SendRaw(buf)
 }
 
-// Close 关闭连接
+// Close 关闭连接，关闭原因类型为CloseKicked
 func (session *AppSession) Close(reason string) {
-	defer func() {
-		// 连接关闭后,触发关闭事件
-		session.closeTrigger(reason)
-	}()
+	session.close(&CloseReason{Kind: CloseKicked, Text: reason})
+}
 
-	slog.Debug(fmt.Sprintf("client[%s] close because %s", session.ID, reason))
-	session.IsClosed = true
-	if session.network == UDP {
+// close 关闭连接，只有第一次调用生效
+func (session *AppSession) close(reason *CloseReason) {
+	session.closeOnce.Do(func() {
+		session.closeReason.Store(reason)
+		defer func() {
+			// 连接关闭后,触发关闭事件
+			session.closeTrigger(reason)
+		}()
+
+		session.log().Debug("session closed", "reason", reason.Text, "kind", reason.Kind.String())
+		session.closed.Store(true)
+		session.IsClosed = true
+		if session.network == UDP {
+			if session.arq != nil {
+				_ = session.arq.Close()
+			}
+			if session.fragmentReassembler != nil {
+				session.fragmentReassembler.Close()
+			}
+			return
+		}
+		if err := session.getConn().Close(); err != nil {
+			session.log().Error("close session error", "error", err.Error())
+		}
+	})
+}
+
+// isClosed 判断会话是否关闭，可在多个协程中调用
+func (session *AppSession) isClosed() bool {
+	return session.closed.Load()
+}
+
+// reject 拒绝未注册的会话，关闭连接但不触发关闭事件
+func (session *AppSession) reject(reason *CloseReason) {
+	session.closeOnce.Do(func() {
+		session.closeReason.Store(reason)
+		session.closed.Store(true)
+		session.IsClosed = true
+		if session.arq != nil {
+			_ = session.arq.Close()
+		}
+		if session.fragmentReassembler != nil {
+			session.fragmentReassembler.Close()
+		}
+		if session.network == TCP {
+			_ = session.getConn().Close()
+		}
+	})
+}
+
+// sendGoodbye 向未注册的会话发送数据，不计入会话统计
+func (session *AppSession) sendGoodbye(buf []byte) error {
+	var err error
+	for _, fn := range session.sendPacketFilter {
+		buf, err = fn(session, buf)
+		if err != nil {
+			return err
+		}
+	}
+	return session.write(buf)
+}
+
+// rateLimitWait 等待限流延迟，数据报并发处理时等待期间归还协程名额，避免阻塞接收数据
+func (session *AppSession) rateLimitWait(wait time.Duration) {
+	if session.udpWorkerSlots == nil {
+		time.Sleep(wait)
 		return
 	}
-	if err := session.conn.Close(); err != nil {
-		slog.Error(fmt.Sprintf("client[%s] close error: %s", session.ID, err.Error()))
+	<-session.udpWorkerSlots
+	time.Sleep(wait)
+	session.udpWorkerSlots <- struct{}{}
+}
+
+// setWriteDeadline 设置发送超时，udp数据报不会阻塞发送，无需设置
+func (session *AppSession) setWriteDeadline(t time.Time) error {
+	switch {
+	case session.network == TCP:
+		return session.getConn().SetWriteDeadline(t)
+	case session.arq != nil:
+		return session.arq.SetWriteDeadline(t)
 	}
+	return nil
+}
+
+// CloseReason 获取会话关闭原因，会话未关闭时返回nil
+func (session *AppSession) CloseReason() *CloseReason {
+	reason, _ := session.closeReason.Load().(*CloseReason)
+	return reason
 }
 
 // AddAttr 添加会话属性
 func (session *AppSession) AddAttr(key string, value interface{}) error {
+	session.attrLock.Lock()
+	defer session.attrLock.Unlock()
+
 	if _, exist := session.attr[key]; exist {
 		return errors.New("attribute already exist")
 	}
@@ -86,11 +460,17 @@ func (session *AppSession) AddAttr(key string, value interface{}) error {
 
 // SetAttr 设置会话属性
 func (session *AppSession) SetAttr(key string, value interface{}) {
+	session.attrLock.Lock()
+	defer session.attrLock.Unlock()
+
 	session.attr[key] = value
 }
 
 // GetAttr 获取会话属性
 func (session *AppSession) GetAttr(key string) (interface{}, error) {
+	session.attrLock.RLock()
+	defer session.attrLock.RUnlock()
+
 	if _, exist := session.attr[key]; exist {
 		return session.attr[key], nil
 	}
@@ -99,9 +479,105 @@ func (session *AppSession) GetAttr(key string) (interface{}, error) {
 
 // DelAttr 删除会话属性
 func (session *AppSession) DelAttr(key string) error {
+	session.attrLock.Lock()
+	defer session.attrLock.Unlock()
+
 	if _, exist := session.attr[key]; !exist {
 		return errors.New("attribute not exist")
 	}
 	delete(session.attr, key)
 	return nil
 }
+
+// Attrs 获取全部会话属性的副本
+func (session *AppSession) Attrs() map[string]interface{} {
+	session.attrLock.RLock()
+	defer session.attrLock.RUnlock()
+
+	attrs := make(map[string]interface{}, len(session.attr))
+	for k, v := range session.attr {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// ConnectedAt 获取会话建立时间
+func (session *AppSession) ConnectedAt() time.Time {
+	return session.connectedAt
+}
+
+// received 记录接收的字节数及时间
+func (session *AppSession) received(n int) {
+	session.lastReadAt.Store(time.Now().UnixNano())
+	session.bytesIn.Add(int64(n))
+}
+
+// BytesReceived 获取会话接收的字节数
+func (session *AppSession) BytesReceived() int64 {
+	return session.bytesIn.Load()
+}
+
+// BytesSent 获取会话发送的字节数
+func (session *AppSession) BytesSent() int64 {
+	return session.bytesOut.Load()
+}
+
+// QueueDepth 获取会话待处理的数据量
+// udp流模式为缓冲区中未拆包的字节数，数据报顺序投递时为队列中的数据报数量，其他为0
+func (session *AppSession) QueueDepth() int {
+	switch {
+	case session.udpQueue != nil:
+		return session.udpQueue.len()
+	case session.udpClientIO != nil:
+		if buffer, ok := session.udpClientIO.(*SafeByteSlice); ok {
+			return buffer.Len()
+		}
+	}
+	return 0
+}
+
+// SessionStats 会话统计快照
+type SessionStats struct {
+	ID               string    // 连接唯一标识
+	Network          Network   // 传输协议
+	RemoteAddr       net.Addr  // 客户端地址
+	LocalAddr        net.Addr  // 服务端地址
+	ConnectedAt      time.Time // 会话建立时间
+	LastReadAt       time.Time // 最后接收数据时间，未接收时为零值
+	LastWriteAt      time.Time // 最后发送数据时间，未发送时为零值
+	BytesReceived    int64     // 接收字节数
+	BytesSent        int64     // 发送字节数
+	FramesReceived   int64     // 接收的消息数
+	FramesSent       int64     // 发送的消息数
+	Errors           int64     // 解析、认证、action及发送错误数
+	DatagramsDropped int64     // 数据报顺序投递队列已满丢弃的数据报数量
+	CurrentAction    string    // 当前正在执行的action路径
+}
+
+// Stats 获取会话统计快照，可在任意协程调用
+func (session *AppSession) Stats() SessionStats {
+	return SessionStats{
+		ID:               session.ID,
+		Network:          session.network,
+		RemoteAddr:       session.RemoteAddr(),
+		LocalAddr:        session.LocalAddr(),
+		ConnectedAt:      session.connectedAt,
+		LastReadAt:       unixNanoTime(session.lastReadAt.Load()),
+		LastWriteAt:      unixNanoTime(session.lastWriteAt.Load()),
+		BytesReceived:    session.bytesIn.Load(),
+		BytesSent:        session.bytesOut.Load(),
+		FramesReceived:   session.framesIn.Load(),
+		FramesSent:       session.framesOut.Load(),
+		Errors:           session.errorCount.Load(),
+		DatagramsDropped: session.datagramsDropped.Load(),
+		CurrentAction:    session.CurrentAction(),
+	}
+}
+
+// unixNanoTime 转换UnixNano时间，0为零值
+func unixNanoTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
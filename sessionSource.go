@@ -2,62 +2,35 @@ package goserver
 
 import (
 	"errors"
-	"log/slog"
 	"sync"
+	"sync/atomic"
 )
 
 // sessionPool 会话管理池
 type sessionPool struct {
-	pool    sync.Map            // 会话池
-	list    chan *sessionHandle // 注册会话的通道
-	counter int                 // 计数器
-}
-
-// sessionHandle 会话管理操作
-type sessionHandle struct {
-	session *AppSession // 会话
-	isAdd   bool        // 是否添加到池，false为从池中移除
+	pool    sync.Map     // 会话池
+	counter atomic.Int64 // 计数器
 }
 
 // addSession 添加会话到池中
+// 同步写入，保证返回后即可通过ID查找到会话，同ID的旧会话被替换
 func (s *sessionPool) addSession(session *AppSession) {
-	s.list <- &sessionHandle{
-		session,
-		true,
+	if _, loaded := s.pool.Swap(session.ID, session); !loaded {
+		s.counter.Add(1)
 	}
 }
 
 // deleteSession 移除Session
+// 仅在池中仍为该会话时移除，避免误删同ID的新会话
 func (s *sessionPool) deleteSession(session *AppSession) {
-	s.list <- &sessionHandle{
-		session,
-		false,
-	}
-}
-
-// sessionPoolManager 会话池管理
-func (s *sessionPool) sessionPoolManager() {
-	for {
-		m, ok := <-s.list
-
-		if !ok {
-			slog.Warn("session pool channel closed")
-			return
-		}
-		// 加入池
-		if m.isAdd {
-			s.pool.Store(m.session.ID, m.session)
-			s.counter++
-		} else {
-			s.pool.Delete(m.session.ID)
-			s.counter--
-		}
+	if s.pool.CompareAndDelete(session.ID, session) {
+		s.counter.Add(-1)
 	}
 }
 
 // 返回会话池数量
 func (s *sessionPool) count() int {
-	return s.counter
+	return int(s.counter.Load())
 }
 
 // 通过ID获取会话
@@ -78,7 +51,7 @@ func (s *sessionPool) getSessionByAttr(cond ConditionFunc) <-chan *AppSession {
 		defer close(result)
 		s.pool.Range(func(id, sessionInterface interface{}) bool {
 			session := sessionInterface.(*AppSession)
-			if cond(session.attr) {
+			if cond(session.Attrs()) {
 				result <- session
 			}
 			return true
@@ -0,0 +1,174 @@
+package goserver
+
+import (
+	"sync"
+	"time"
+)
+
+// span名称
+const (
+	SpanMessage          = "message"           // 处理一个拆包后的消息，其余span的父span
+	SpanResolve          = "resolve"           // 解析请求方法
+	SpanAuthenticate     = "authenticate"      // 认证
+	SpanBeforeMiddleware = "before_middleware" // action执行前中间件
+	SpanAction           = "action"            // action
+	SpanAfterMiddleware  = "after_middleware"  // action执行后中间件
+	SpanSend             = "send"              // 发送action返回的数据
+)
+
+// span及日志属性名
+const (
+	AttrSessionID  = "session_id"  // 会话ID
+	AttrRemoteAddr = "remote_addr" // 客户端地址
+	AttrNetwork    = "network"     // 传输协议
+	AttrAction     = "action"      // action路径
+	AttrSize       = "size"        // 数据长度
+	AttrIndex      = "index"       // 中间件或action在调用链中的序号
+)
+
+// SpanAttr span属性
+type SpanAttr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span 追踪片段
+type Span interface {
+	SetAttr(key string, value interface{}) // 设置属性
+	End(err error)                         // 结束，err为处理过程中的错误
+}
+
+// Tracer 链路追踪接口，可实现此接口对接其他追踪系统
+type Tracer interface {
+	StartSpan(parent Span, name string, attrs ...SpanAttr) Span // 开始span，parent为nil时为根span
+}
+
+// nopTracer 不追踪
+type nopTracer struct{}
+
+func (nopTracer) StartSpan(Span, string, ...SpanAttr) Span { return nopSpan{} }
+
+// nopSpan 不记录的span
+type nopSpan struct{}
+
+func (nopSpan) SetAttr(string, interface{}) {}
+func (nopSpan) End(error)                   {}
+
+// RecordedSpan 记录的span
+type RecordedSpan struct {
+	ID       uint64                 // span ID，从1开始
+	ParentID uint64                 // 父span ID，根span为0
+	Name     string                 // span名称
+	Attrs    map[string]interface{} // 属性
+	Start    time.Time              // 开始时间
+	End      time.Time              // 结束时间
+	Err      error                  // 错误
+}
+
+// TraceRecorder 进程内追踪记录器，记录已结束的span，可用于测试及调试
+type TraceRecorder struct {
+	spans  []RecordedSpan
+	nextID uint64
+	sync.Mutex
+}
+
+// NewTraceRecorder 新建追踪记录器
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+// StartSpan 开始span
+func (r *TraceRecorder) StartSpan(parent Span, name string, attrs ...SpanAttr) Span {
+	r.Lock()
+	defer r.Unlock()
+
+	r.nextID++
+	span := &recordingSpan{
+		recorder: r,
+		span: RecordedSpan{
+			ID:    r.nextID,
+			Name:  name,
+			Attrs: make(map[string]interface{}, len(attrs)),
+			Start: time.Now(),
+		},
+	}
+	if p, ok := parent.(*recordingSpan); ok && p.recorder == r {
+		span.span.ParentID = p.span.ID
+	}
+	for _, attr := range attrs {
+		span.span.Attrs[attr.Key] = attr.Value
+	}
+	return span
+}
+
+// Spans 返回已结束的span，按结束顺序排列
+func (r *TraceRecorder) Spans() []RecordedSpan {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+// Reset 清空记录
+func (r *TraceRecorder) Reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.spans = nil
+}
+
+// recordingSpan 记录中的span
+type recordingSpan struct {
+	recorder *TraceRecorder
+	span     RecordedSpan
+	ended    bool
+}
+
+// SetAttr 设置属性
+func (s *recordingSpan) SetAttr(key string, value interface{}) {
+	s.recorder.Lock()
+	defer s.recorder.Unlock()
+
+	s.span.Attrs[key] = value
+}
+
+// End 结束span并记录，重复调用无效
+func (s *recordingSpan) End(err error) {
+	s.recorder.Lock()
+	defer s.recorder.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	s.span.Err = err
+	attrs := make(map[string]interface{}, len(s.span.Attrs))
+	for k, v := range s.span.Attrs {
+		attrs[k] = v
+	}
+	recorded := s.span
+	recorded.Attrs = attrs
+	s.recorder.spans = append(s.recorder.spans, recorded)
+}
+
+// SetTracer 设置链路追踪，可使用内置的NewTraceRecorder
+func (server *Server) SetTracer(tracer Tracer) error {
+	if server.running.Load() {
+		return ErrServerRunning
+	}
+
+	if tracer == nil {
+		tracer = nopTracer{}
+	}
+	server.tracer = tracer
+	return nil
+}
+
+// traceCall 在子span中调用中间件或action
+func (server *Server) traceCall(parent Span, name string, index int, fn ActionFunc, session *AppSession, token []byte) ([]byte, error) {
+	span := server.tracer.StartSpan(parent, name, SpanAttr{AttrIndex, index}, SpanAttr{AttrSize, len(token)})
+	token, err := fn(session, token)
+	span.End(err)
+	return token, err
+}